@@ -0,0 +1,222 @@
+package godesim
+
+import (
+	"math"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/diff/fd"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Adjoint computes the gradient of a scalar cost of a simulation
+//  cost = Terminal(x(T)) + ∫ Running(x(t)) dt
+// with respect to all Params by integrating the adjoint equations
+//  dλ/dt = -Jᵀλ - ∂Running/∂x,          λ(T) = ∂Terminal/∂x
+//  dμ/dt = -∂Diffsᵀ/∂p λ - ∂Running/∂p, μ(T) = ∂Terminal/∂p
+// backward from the end of the simulation. The gradient is μ at the start of the simulation
+// and the gradient with respect to initial X values is λ. Unlike forward sensitivities
+// the cost of the backward pass barely grows with the amount of parameters.
+//
+// Simulation results serve as checkpoints: between consecutive results the model
+// is integrated again from the earlier result so that only the states of
+// one interval are kept in memory during the backward pass. Steps are subdivided until
+// the integration matches the later result. If it can not, as when results of a long
+// step carry the solver's error, the largest mismatch is reported in AdjointResult.Drift.
+// J is analytic if set with SetJacobian and ∂Diffs/∂p if set with SetParamJacobian.
+// Events which change Diffs are not supported.
+type Adjoint struct {
+	// Params are the parameters, set with SetParamsFromMap, with respect to which the gradient is computed.
+	Params []state.Symbol
+	// Running is the integrand of the cost. May be nil.
+	Running func(s state.State) float64
+	// Terminal is the cost at the end of the simulation. May be nil.
+	Terminal func(s state.State) float64
+	// Steps is the least amount of fourth order Runge-Kutta steps of the adjoint
+	// equations between consecutive results. Default is 4.
+	Steps int
+}
+
+// AdjointResult contains the cost of a simulation and it's gradient.
+type AdjointResult struct {
+	Cost float64
+	// Gradient contains the derivative of Cost with respect to each parameter.
+	Gradient map[state.Symbol]float64
+	// X0 contains the derivative of Cost with respect to each initial X value.
+	X0 map[state.Symbol]float64
+	// Drift is the largest mismatch between a result and the integration from the previous
+	// result relative to error tolerance. Above 1 the gradient is that of the
+	// integration, not of the results.
+	Drift float64
+}
+
+// Gradient runs sim and computes the cost and it's gradient.
+// sim must be ready to Begin and must not have sensitivities enabled.
+func (adj Adjoint) Gradient(sim *Simulation) AdjointResult {
+	if adj.Running == nil && adj.Terminal == nil {
+		throwf("Adjoint: no Running or Terminal cost set")
+	}
+	if sim.sensitivity != nil {
+		throwf("Adjoint: not supported for simulations with sensitivities enabled")
+	}
+	for _, p := range adj.Params {
+		if _, ok := sim.params[p]; !ok {
+			throwf("Adjoint: parameter %v not set. Use SetParamsFromMap", p)
+		}
+	}
+	steps := adj.Steps
+	if steps <= 0 {
+		steps = 4
+	}
+	sim.Begin()
+	checkpoints := sim.results
+	last := checkpoints[len(checkpoints)-1]
+	n, np := last.Len(), len(adj.Params)
+	aj := &adjointSystem{
+		Adjoint: adj,
+		sim:     sim,
+		jac:     mat.NewDense(n, n, nil),
+		pjac:    mat.NewDense(n, max(np, 1), nil),
+	}
+	res := AdjointResult{Gradient: make(map[state.Symbol]float64, np), X0: make(map[state.Symbol]float64, n)}
+	// y contains λ followed by μ
+	y := make([]float64, n+np)
+	if adj.Terminal != nil {
+		res.Cost = adj.Terminal(last)
+		copy(y[:n], aj.gradX(adj.Terminal, last))
+		copy(y[n:], aj.gradP(adj.Terminal, last))
+	}
+	for k := len(checkpoints) - 1; k > 0; k-- {
+		xs, mismatch := sim.replay(checkpoints[k-1], checkpoints[k], steps)
+		res.Drift = math.Max(res.Drift, mismatch)
+		h := (checkpoints[k].Time() - checkpoints[k-1].Time()) / float64((len(xs)-1)/2)
+		for i := len(xs) - 1; i > 0; i -= 2 {
+			y = aj.step(y, xs[i], xs[i-1], xs[i-2], h)
+			if adj.Running != nil {
+				// Simpson's rule
+				res.Cost += h / 6 * (adj.Running(xs[i-2]) + 4*adj.Running(xs[i-1]) + adj.Running(xs[i]))
+			}
+		}
+	}
+	for i, sym := range last.XSymbols() {
+		res.X0[sym] = y[i]
+	}
+	for j, sym := range adj.Params {
+		res.Gradient[sym] = y[n+j]
+	}
+	return res
+}
+
+// maxReplayHalvings is the amount of times replay halves step length
+// before giving up on converging.
+const maxReplayHalvings = 8
+
+// minReplayRelTol is the relative tolerance with which replayed states
+// match results when a smaller one is not configured.
+const minReplayRelTol = 1e-5
+
+// replay integrates the model again from result s0 to the following result s1
+// with fourth order Runge-Kutta half steps and returns the 2*steps+1 states,
+// RK4 stage states at odd indices. Since s1 may have been obtained by a different
+// solver or with longer steps the amount of steps is doubled until the end state
+// matches s1 within the simulation's error tolerance or halving steps no longer
+// reduces the mismatch, in which case s1 carries the error of the solver.
+// The returned mismatch is the largest error of the end state relative to tolerance.
+func (sim *Simulation) replay(s0, s1 state.State, steps int) (xs []state.State, mismatch float64) {
+	x1 := s1.XVector()
+	prev := math.Inf(1)
+	for halvings := 0; ; halvings++ {
+		h := (s1.Time() - s0.Time()) / float64(steps)
+		xs = make([]state.State, 2*steps+1)
+		xs[0] = s0.Clone()
+		for i := 1; i < len(xs); i++ {
+			xs[i] = rk4Step(sim.Diffs, xs[i-1], h/2)
+		}
+		mismatch = 0
+		for i, v := range xs[len(xs)-1].XVector() {
+			rel := sim.tolerances.rel[i]
+			if rel == 0 {
+				rel = minReplayRelTol
+			}
+			mismatch = math.Max(mismatch, math.Abs(v-x1[i])/(sim.tolerances.abs[i]+rel*math.Abs(x1[i])))
+		}
+		if math.IsNaN(mismatch) || halvings == maxReplayHalvings {
+			throwf("integration from %s=%g does not converge to result at %g. Refine Timespan",
+				sim.Domain, s0.Time(), s1.Time())
+		}
+		if mismatch <= 1 || mismatch > prev/2 {
+			return xs, mismatch
+		}
+		prev = mismatch
+		steps *= 2
+	}
+}
+
+// adjointSystem holds storage for evaluating the adjoint equations.
+type adjointSystem struct {
+	Adjoint
+	sim       *Simulation
+	jac, pjac *mat.Dense
+}
+
+// step integrates the adjoint equations y backward a step of length h with
+// fourth order Runge-Kutta. s1 is the model state at the start of the
+// backward step, sm at the middle and s0 at the end.
+func (aj *adjointSystem) step(y []float64, s1, sm, s0 state.State, h float64) []float64 {
+	k1 := aj.rhs(s1, y)
+	k2 := aj.rhs(sm, floats.AddScaledTo(make([]float64, len(y)), y, -h/2, k1))
+	k3 := aj.rhs(sm, floats.AddScaledTo(make([]float64, len(y)), y, -h/2, k2))
+	k4 := aj.rhs(s0, floats.AddScaledTo(make([]float64, len(y)), y, -h, k3))
+	floats.Add(k1, k4)
+	floats.Add(k2, k3)
+	floats.AddScaled(k1, 2, k2)
+	return floats.AddScaledTo(make([]float64, len(y)), y, -h/6, k1)
+}
+
+// rhs returns the derivative of adjoint variables y at model state s.
+func (aj *adjointSystem) rhs(s state.State, y []float64) []float64 {
+	sim := aj.sim
+	n, np := s.Len(), len(aj.Params)
+	dy := make([]float64, len(y))
+	lambda := mat.NewVecDense(n, y[:n])
+	sim.stats.JacobianEvaluations++
+	sim.jacobianOf(aj.jac, sim.Diffs, s)
+	mat.NewVecDense(n, dy[:n]).MulVec(aj.jac.T(), lambda)
+	if np > 0 {
+		sim.paramJacobianAt(aj.pjac, s, sim.Diffs, aj.Params)
+		mat.NewVecDense(np, dy[n:]).MulVec(aj.pjac.T(), lambda)
+	}
+	if aj.Running != nil {
+		floats.Add(dy[:n], aj.gradX(aj.Running, s))
+		floats.Add(dy[n:], aj.gradP(aj.Running, s))
+	}
+	floats.Scale(-1, dy)
+	return dy
+}
+
+// gradX returns the gradient of f with respect to X at s.
+func (aj *adjointSystem) gradX(f func(state.State) float64, s state.State) []float64 {
+	return fd.Gradient(nil, func(x []float64) float64 {
+		sx := s.Clone()
+		sx.SetAllX(append([]float64{}, x...))
+		return f(sx)
+	}, s.XVector(), nil)
+}
+
+// gradP returns the gradient of f with respect to Params at s.
+func (aj *adjointSystem) gradP(f func(state.State) float64, s state.State) []float64 {
+	if len(aj.Params) == 0 {
+		return nil
+	}
+	p0 := make([]float64, len(aj.Params))
+	for j, sym := range aj.Params {
+		p0[j] = s.P(sym)
+	}
+	return fd.Gradient(nil, func(p []float64) float64 {
+		sp := s.Clone()
+		for j, sym := range aj.Params {
+			sp.PSet(sym, p[j])
+		}
+		return f(sp)
+	}, p0, nil)
+}
@@ -0,0 +1,116 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Exponential decay with cost
+//  x(T)^2 + ∫ x^2 dt = x0^2*exp(-2kT) + x0^2*(1-exp(-2kT))/(2k)
+func TestAdjointDecay(t *testing.T) {
+	const k, x0, T = 0.5, 2., 3.
+	sim := New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return -s.P("k") * s.X("x") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": x0})
+	sim.SetParamsFromMap(map[state.Symbol]float64{"k": k})
+	sim.SetTimespan(0, T, 30)
+	square := func(s state.State) float64 { return s.X("x") * s.X("x") }
+	res := Adjoint{Params: []state.Symbol{"k"}, Running: square, Terminal: square}.Gradient(sim)
+
+	e := math.Exp(-2 * k * T)
+	cost := x0*x0*e + x0*x0*(1-e)/(2*k)
+	dk := -2*T*x0*x0*e + x0*x0*(2*T*e*2*k-2*(1-e))/(4*k*k)
+	dx0 := 2*x0*e + x0*(1-e)/k
+	if math.Abs(res.Cost-cost) > 1e-6 {
+		t.Errorf("cost: got %g, want %g", res.Cost, cost)
+	}
+	if math.Abs(res.Gradient["k"]-dk) > 1e-5 {
+		t.Errorf("∂cost/∂k: got %g, want %g", res.Gradient["k"], dk)
+	}
+	if math.Abs(res.X0["x"]-dx0) > 1e-5 {
+		t.Errorf("∂cost/∂x(0): got %g, want %g", res.X0["x"], dx0)
+	}
+}
+
+// Gradient of a predator-prey cost agrees with finite differences.
+func TestAdjointFiniteDifference(t *testing.T) {
+	params := map[state.Symbol]float64{"a": 1.5, "b": 0.8, "c": 0.2}
+	adj := Adjoint{
+		Params:   []state.Symbol{"a", "b", "c"},
+		Terminal: func(s state.State) float64 { return s.X("prey") },
+		Running:  func(s state.State) float64 { return s.X("pred") * s.P("c") },
+	}
+	model := func(p map[state.Symbol]float64) *Simulation {
+		sim := New()
+		sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+			"prey": func(s state.State) float64 { return s.X("prey") * (s.P("a") - s.X("pred")) },
+			"pred": func(s state.State) float64 { return s.X("pred") * (s.X("prey") - s.P("b")) },
+		})
+		sim.SetX0FromMap(map[state.Symbol]float64{"prey": 1, "pred": 0.5})
+		sim.SetParamsFromMap(p)
+		sim.SetTimespan(0, 3, 100)
+		return sim
+	}
+	res := adj.Gradient(model(params))
+	const h = 1e-5
+	for _, p := range adj.Params {
+		plus, minus := model(params), model(params)
+		plus.overrideParams(map[state.Symbol]float64{p: params[p] + h})
+		minus.overrideParams(map[state.Symbol]float64{p: params[p] - h})
+		want := (adj.Gradient(plus).Cost - adj.Gradient(minus).Cost) / (2 * h)
+		if got := res.Gradient[p]; math.Abs(got-want) > 1e-4*math.Max(1, math.Abs(want)) {
+			t.Errorf("∂cost/∂%s: got %g, want %g", p, got, want)
+		}
+	}
+	if err := recoverFromAdjoint(Adjoint{Params: []state.Symbol{"d"}, Terminal: adj.Terminal}, model(params)); err == nil {
+		t.Error("expected panic for gradient of parameter not set")
+	}
+}
+
+func recoverFromAdjoint(adj Adjoint, sim *Simulation) (i interface{}) {
+	defer func() {
+		i = recover()
+	}()
+	adj.Gradient(sim)
+	return nil
+}
+
+// Long adaptive steps between results are subdivided when integrated again so that
+// the gradient matches the trajectory, while a trajectory of a long Runge-Kutta
+// step which can not be matched is reported as drift.
+func TestAdjointReplay(t *testing.T) {
+	const k, x0, T = 0.5, 2., 3.
+	model := func() *Simulation {
+		sim := New()
+		sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+			"x": func(s state.State) float64 { return -s.P("k") * s.X("x") },
+		})
+		sim.SetX0FromMap(map[state.Symbol]float64{"x": x0})
+		sim.SetParamsFromMap(map[state.Symbol]float64{"k": k})
+		sim.SetTimespan(0, T, 1)
+		return sim
+	}
+	square := func(s state.State) float64 { return s.X("x") * s.X("x") }
+	sim := model()
+	sim.Solver = RKF78Solver
+	sim.Algorithm.Error.RelTol = 1e-8
+	sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-6, T
+	res := Adjoint{Params: []state.Symbol{"k"}, Terminal: square, Steps: 1}.Gradient(sim)
+	if res.Drift > 1 {
+		t.Errorf("expected results to be matched within tolerance, got drift %g", res.Drift)
+	}
+	e := math.Exp(-2 * k * T)
+	if dk := -2 * T * x0 * x0 * e; math.Abs(res.Gradient["k"]-dk) > 1e-6 {
+		t.Errorf("∂cost/∂k: got %g, want %g", res.Gradient["k"], dk)
+	}
+
+	sim = model()
+	sim.Solver = RK4Solver
+	if res = (Adjoint{Params: []state.Symbol{"k"}, Terminal: square}).Gradient(sim); res.Drift <= 1 {
+		t.Errorf("expected drift of single RK4 step to exceed tolerance, got %g", res.Drift)
+	}
+}
@@ -4,50 +4,59 @@ import (
 	"math"
 
 	"github.com/soypat/godesim/state"
-	"gonum.org/v1/exp/linsolve"
-	"gonum.org/v1/gonum/diff/fd"
-	"gonum.org/v1/gonum/floats"
-	"gonum.org/v1/gonum/mat"
 )
 
 // RK4Solver Integrates simulation state for next timesteps
 // using 4th order Runge-Kutta multivariable algorithm
 func RK4Solver(sim *Simulation) []state.State {
-	const overSix float64 = 1. / 6.
 	states := make([]state.State, sim.Algorithm.Steps+1)
 	h := sim.Dt() / float64(sim.Algorithm.Steps)
 	states[0] = sim.State.Clone()
 	for i := 0; i < len(states)-1; i++ {
-		// create auxiliary states for calculation
-		t := states[i].Time()
-		b, c, d := states[i].CloneBlank(t+.5*h), states[i].CloneBlank(t+.5*h), states[i].CloneBlank(t+h)
+		states[i+1] = rk4Step(sim.Diffs, states[i], h)
+	}
+	return states
+}
 
-		a := StateDiff(sim.Diffs, states[i])
+// rk4Step returns the state after a fourth order Runge-Kutta step of length h from s.
+func rk4Step(F state.Diffs, s state.State, h float64) state.State {
+	const overSix float64 = 1. / 6.
+	// create auxiliary states for calculation
+	t := s.Time()
+	b, c, d := s.CloneBlank(t+.5*h), s.CloneBlank(t+.5*h), s.CloneBlank(t+h)
 
-		state.AddScaledTo(b, states[i], 0.5*h, a)
-		b = StateDiff(sim.Diffs, b)
+	a := StateDiff(F, s)
 
-		state.AddScaledTo(c, states[i], 0.5*h, b)
-		c = StateDiff(sim.Diffs, c)
+	state.AddScaledTo(b, s, 0.5*h, a)
+	b = StateDiff(F, b)
 
-		state.AddScaledTo(d, states[i], h, c)
-		d = StateDiff(sim.Diffs, d)
+	state.AddScaledTo(c, s, 0.5*h, b)
+	c = StateDiff(F, c)
 
-		state.Add(a, d)
-		state.Add(b, c)
-		state.AddScaled(a, 2, b)
-		states[i+1] = states[i].Clone()
-		state.AddScaled(states[i+1], h*overSix, a)
-		states[i+1].SetTime(h + states[i].Time())
-	}
-	return states
+	state.AddScaledTo(d, s, h, c)
+	d = StateDiff(F, d)
+
+	state.Add(a, d)
+	state.Add(b, c)
+	state.AddScaled(a, 2, b)
+	next := s.Clone()
+	state.AddScaled(next, h*overSix, a)
+	next.SetTime(h + t)
+	return next
 }
 
 // RKF45Solver Runge-Kutta-Fehlberg of Orders 4 and 5 solver
 //
 // To enable adaptive stepping, Config.Algorithm.Step Min/Max values
-// must be set and a Config.Error.Min must be specified in configuration.
+// must be set and an error tolerance must be specified in Config.Algorithm.Error.
+// Step lengths are proposed by Simulation.StepController, starting from
+// a step length estimated from the derivatives at the start of the simulation.
+// Each call integrates up to the end of the Timespan interval.
 func RKF45Solver(sim *Simulation) []state.State {
+	return rkf45(sim, &sim.adaptive)
+}
+
+func rkf45(sim *Simulation, st *AdaptiveState) []state.State {
 	// Butcher Tableau for Fehlbergs  4(5) method (Table III https://en.wikipedia.org/wiki/Runge%E2%80%93Kutta%E2%80%93Fehlberg_method)
 	const c20, c21 = 1. / 4., 1. / 4.
 	const c30, c31, c32 = 3. / 8., 3. / 32., 9. / 32.
@@ -58,13 +67,23 @@ func RKF45Solver(sim *Simulation) []state.State {
 	const a1, a3, a4, a5 = 25. / 216., 1408. / 2565., 2197. / 4104., -1. / 5.
 	// Fifth order
 	const b1, b3, b4, b5, b6 = 16. / 135., 6656. / 12825., 28561. / 56430., -9. / 50., 2. / 55.
-	adaptive := sim.Algorithm.Error.Max > 0 && sim.Algorithm.Step.Min > 0 && sim.Algorithm.Step.Max > sim.Algorithm.Step.Min
-	states := make([]state.State, sim.Algorithm.Steps+1)
+	adaptive := sim.hasTolerance() && sim.Algorithm.Step.Min > 0 && sim.Algorithm.Step.Max > sim.Algorithm.Step.Min
 	h := sim.Dt() / float64(sim.Algorithm.Steps)
+	// hnext is the step length proposed by the StepController. Adaptive
+	// stepping integrates up to the end of the Timespan interval.
+	hnext := math.Abs(h)
+	if adaptive {
+		hnext = st.start(sim, sim.State, 4)
+	}
+	states := make([]state.State, 1, sim.Algorithm.Steps+1)
 	states[0] = sim.State.Clone()
-	for i := 0; i < len(states)-1; i++ {
+	tend := states[0].Time() + sim.Dt()
+	for i := 0; sim.stepping(adaptive, i, states[i].Time(), tend); i++ {
 		// create auxiliary states for calculation
 		t := states[i].Time()
+		if adaptive {
+			h = math.Copysign(math.Min(hnext, math.Abs(tend-t)), sim.Dt())
+		}
 		k2, k3, k4, k5, k6, s4, s5, err45 := states[i].CloneBlank(t+c20*h), states[i].CloneBlank(t+c30*h), states[i].CloneBlank(t+c40*h),
 			states[i].CloneBlank(t+c50*h), states[i].CloneBlank(t+c60*h), states[i].CloneBlank(t+h), states[i].CloneBlank(t+h), states[i].CloneBlank(t+h)
 
@@ -108,8 +127,6 @@ func RKF45Solver(sim *Simulation) []state.State {
 		state.AddScaled(s5, b5, k5)
 		state.AddScaled(s5, b6, k6)
 
-		// assign solution
-		states[i+1] = s5.Clone()
 		// Adaptive timestep block. Modify step length if necessary
 		if adaptive {
 			// fourth order approximation calc
@@ -118,42 +135,78 @@ func RKF45Solver(sim *Simulation) []state.State {
 			state.AddScaled(s4, a4, k4)
 			state.AddScaled(s4, a5, k5)
 			// Error and adaptive timestep implementation
-			state.Abs(state.SubTo(err45, s4, s5))
-			errRatio := sim.Algorithm.Error.Max / state.Max(err45)
-			hnew := math.Min(math.Max(0.9*h*math.Pow(errRatio, .2), sim.Algorithm.Step.Min), sim.Algorithm.Step.Max)
-			sim.Algorithm.Steps = int(math.Max(float64(sim.Algorithm.Steps)*(h/hnew), 1.0))
-			h = hnew
+			state.SubTo(err45, s4, s5)
+			hnew, accept := sim.controlStep(math.Abs(h), sim.errorNorm(err45, states[i], s5), 4)
 			// If we do not have desired error, and have not reached minimum timestep, repeat step
-			if errRatio < 1 && h != sim.Algorithm.Step.Min {
+			if !accept {
+				hnext = hnew
 				i--
 				continue
 			}
+			// a step shortened to land on the interval end does not limit the next step
+			if math.Abs(h) == hnext {
+				hnext = hnew
+			}
 		}
+		// assign solution
+		states = append(states, s5.Clone())
+	}
+	if adaptive {
+		st.h = hnext
 	}
 	return states
 }
 
 // NewtonRaphsonSolver is an implicit solver which may calculate
-// the jacobian several times on each algorithm step.
+// the jacobian several times on each algorithm step. The jacobian
+// set with Simulation.SetJacobian is used if available. If a jacobian
+// sparsity pattern is set or detected the finite difference jacobian
+// is approximated with column coloring and stored as a sparse matrix.
+//
+// Small systems are solved with a direct LU factorization. With
+// Config.Algorithm.Newton.Modified set the factorization is reused across
+// iterations and steps and only recomputed when convergence slows or the
+// step length changes significantly.
+//
+// Steps which do not converge within Config.Algorithm.IterationMax iterations,
+// whose linear system GMRES fails to solve or which yield NaN/Inf values are
+// retried with half the step length down to Config.Algorithm.Step.Min, after
+// which the simulation panics. With fixed stepping the retried substeps are not
+// kept in the results. Failures are counted in Simulation.Stats and may be
+// recorded as events with Config.Algorithm.Newton.FailureEvents.
+//
+// To enable adaptive stepping, Config.Algorithm.Step Min/Max values must be set.
+// The local truncation error is estimated by comparison with the trapezoidal
+// rule and kept under Config.Algorithm.Error.Max. Step lengths are
+// proposed by Simulation.StepController, starting from a step length
+// estimated from the derivatives at the start of the simulation.
 //
-// sim.Algorithm.Error.Max should be set to a value above 0 for
-// good run
+// Newton iterations converge once the iterate changes less than Config.Algorithm.Newton.Tolerance,
+// 1e-5 if not set, within Config.Algorithm.IterationMax iterations, 10 if not set.
 func NewtonRaphsonSolver(sim *Simulation) []state.State {
-	if sim.Algorithm.Error.Max <= 0 {
-		sim.Algorithm.Error.Max = 1e-5 // throwf("set config Algorithm.Error.Max to a value above 0 to use NewtonRaphson method")
-	}
-	jacMult := 1 - sim.Algorithm.RelaxationFactor
-
-	if sim.Algorithm.IterationMax <= 0 {
-		sim.Algorithm.IterationMax = 10
-	}
+	return newtonRaphson(sim, &sim.adaptive)
+}
 
-	adaptive := sim.Algorithm.Error.Max > 0
+func newtonRaphson(sim *Simulation, st *AdaptiveState) []state.State {
 	n := len(sim.Diffs)
+	adaptive := sim.Algorithm.Step.Min > 0 && sim.Algorithm.Step.Max > sim.Algorithm.Step.Min
 
-	states := make([]state.State, sim.Algorithm.Steps+1)
+	states := make([]state.State, 1, sim.Algorithm.Steps+1)
 	states[0] = sim.State.Clone()
-	h := sim.Dt() / float64(sim.Algorithm.Steps)
+	// step lengths are positive, dir is the direction of integration
+	dir := math.Copysign(1, sim.Dt())
+	h := math.Abs(sim.Dt()) / float64(sim.Algorithm.Steps)
+	// smallest step length permitted when retrying failed steps
+	hmin := sim.Algorithm.Step.Min
+	if hmin <= 0 || (!adaptive && hmin > h) {
+		hmin = h / (1 << newtonMaxHalvings)
+	}
+	// Adaptive stepping integrates the whole Timespan step, adjusting step length as it goes.
+	// Fixed stepping integrates sim.Algorithm.Steps steps.
+	steps := sim.Algorithm.Steps
+	if adaptive {
+		steps = 1
+	}
 
 	residualers := make([]func(step float64, now state.State) func(next state.State) float64, n)
 	for loopi, loopsym := range sim.State.XSymbols() {
@@ -166,74 +219,90 @@ func NewtonRaphsonSolver(sim *Simulation) []state.State {
 	}
 	// initialize residual functions iteration storage
 	F := make(state.Diffs, n)
-	// Init guess
-	guess := states[0].Clone()
-	auxState := states[0].Clone()
-	for i := 0; i < len(states)-1; i++ {
-
-		old := guess.Clone()
-		guess.SetTime(states[i].Time() + h)
-		// iteration loop counter
-		iter := 0
-		ierr := 0.0
-		// |X_(g) - X_(i)| < permissible error
-		for iter == 0 || (adaptive && iter < sim.Algorithm.IterationMax && ierr > sim.Config.Algorithm.Error.Max) {
+	if sim.newton == nil || sim.newton.n != n {
+		sim.newton = newNewtonSystem(sim, n)
+	}
+	hs := h
+	if adaptive {
+		hs = st.start(sim, states[0], 1)
+	}
+	for i := 0; i < steps; i++ {
+		tnext := states[0].Time() + float64(i+1)*sim.Dt()/float64(steps)
+		if !adaptive {
+			hs = h
+		}
+		// Failed steps are retried with half the step length until tnext is reached.
+		// Fixed stepping only keeps the state at tnext.
+		cur := states[len(states)-1]
+		for dir*(tnext-cur.Time()) > h*1e-9 {
+			old := cur
+			hs = math.Min(hs, dir*(tnext-old.Time()))
+			step := dir * hs
 			// First propose residual functions such that
 			// F(X_(i+1)) = 0 = X_(i+1) - X_(i) - step * f(X_(i+1))
 			// where f is the vector of differential equations
 			for i := range residualers {
-				F[i] = residualers[i](h, old)
+				F[i] = residualers[i](step, old)
 			}
-
-			// We solve  J^-1 * b  where b = F(X_(g)) and J = J(X_(g))
-			b := mat.NewVecDense(n, StateDiff(F, guess).XVector())
-			Jaux := mat.NewDense(n, n, nil)
-			var settings *fd.JacobianSettings = nil //&fd.JacobianSettings{Formula: fd.Forward, Step: 1e-6}
-			state.Jacobian(Jaux, F, guess, settings)
-			J := denseToBand(Jaux)
-
-			result, err := linsolve.Iterative(J, b, &linsolve.GMRES{}, &linsolve.Settings{MaxIterations: 2})
-			if err != nil {
-				throwf("error in newton iterative solver: %s", err)
+			guess := old.Clone()
+			guess.SetTime(old.Time() + step)
+			guess, status := newtonIterate(sim, F, guess, step)
+			if status == newtonConverged && !adaptive {
+				cur = guess
+				continue
+			}
+			if status == newtonConverged {
+				// Local truncation error of backward Euler is estimated as the
+				// difference with the trapezoidal rule solution
+				//  X_(i+1) - X_(i) - step/2 * (f(X_(i)) + f(X_(i+1)))
+				trap := StateDiff(sim.Diffs, old)
+				state.Add(trap, StateDiff(sim.Diffs, guess))
+				state.AddScaledTo(trap, old, step/2, trap)
+				state.Sub(trap, guess)
+				hnew, accept := sim.controlStep(hs, sim.errorNorm(trap, old, guess), 1)
+				// If we do not have desired error, and have not reached minimum timestep, repeat step
+				if !accept {
+					hs = hnew
+					continue
+				}
+				states = append(states, guess)
+				cur, hs = guess, hnew
+				continue
+			}
+			sim.newtonFailure(status, old, hs)
+			if sim.Algorithm.Newton.Modified && !sim.newton.fresh {
+				sim.newton.valid = false // retry with an up to date jacobian first
+				continue
 			}
-			auxState.SetAllX(result.X.RawVector().Data)
-
-			// X_(i+1) = X_(i) - alpha * F(X_(g)) / J(X_(g)) where g are guesses, and alpha is the relaxation factor
-			state.AddScaledTo(auxState, guess, -jacMult, auxState)
-			// error calculation
-			errvec := guess.XVector()
-			floats.Sub(errvec, auxState.XVector())
-			for i := range errvec {
-				errvec[i] = math.Abs(errvec[i])
+			if hs <= hmin {
+				throwf("NewtonRaphsonSolver: %s at %s=%g with minimum step length %g", status, sim.Domain, old.Time(), hs)
 			}
-			ierr = floats.Max(errvec)
-			guess.SetAllX(auxState.XVector())
-			iter++
+			hs = math.Max(hs/2, hmin)
+			sim.stats.Rejected++
 		}
-
-		states[i+1] = guess.Clone()
-	}
-
-	return states
-}
-
-func denseToBand(d *mat.Dense) *mat.BandDense {
-	r, c := d.Caps()
-	b := mat.NewBandDense(r, c, r-1, c-1, nil)
-	for i := 0; i < r; i++ {
-		for j := 0; j < c; j++ {
-			b.SetBand(i, j, d.At(i, j))
+		if !adaptive {
+			states = append(states, cur)
 		}
 	}
-	return b
+	if adaptive {
+		st.h = hs
+	}
+	return states
 }
 
 // DormandPrinceSolver. Very similar to RKF45. Used by Matlab in ode45 solver
 // and Simulink's system solver by default.
 //
 // To enable adaptive stepping, Config.Algorithm.Step Min/Max values
-// must be set and a Config.Error.Min must be specified in configuration.
+// must be set and an error tolerance must be specified in Config.Algorithm.Error.
+// Step lengths are proposed by Simulation.StepController, starting from
+// a step length estimated from the derivatives at the start of the simulation.
+// Each call integrates up to the end of the Timespan interval.
 func DormandPrinceSolver(sim *Simulation) []state.State {
+	return dormandPrince(sim, &sim.adaptive)
+}
+
+func dormandPrince(sim *Simulation, st *AdaptiveState) []state.State {
 	// Butcher Tableau for Fehlbergs  4(5) method (Table III https://en.wikipedia.org/wiki/Runge%E2%80%93Kutta%E2%80%93Fehlberg_method)
 	const c20, c21 = 1. / 5., 1. / 5.
 	const c30, c31, c32 = 3. / 10., 3. / 40., 9. / 40.
@@ -245,13 +314,23 @@ func DormandPrinceSolver(sim *Simulation) []state.State {
 	const a1, a3, a4, a5, a6, a7 = 5179. / 57600., 7571. / 16695., 393. / 640., -92097. / 339200., 187. / 2100., 1. / 40.
 	// Fifth order
 	const b1, b3, b4, b5, b6 = 35. / 384., 500. / 1113., 125. / 192., -2187. / 6784., 11. / 84.
-	adaptive := sim.Algorithm.Error.Max > 0 && sim.Algorithm.Step.Min > 0 && sim.Algorithm.Step.Max > sim.Algorithm.Step.Min
-	states := make([]state.State, sim.Algorithm.Steps+1)
+	adaptive := sim.hasTolerance() && sim.Algorithm.Step.Min > 0 && sim.Algorithm.Step.Max > sim.Algorithm.Step.Min
 	h := sim.Dt() / float64(sim.Algorithm.Steps)
+	// hnext is the step length proposed by the StepController. Adaptive
+	// stepping integrates up to the end of the Timespan interval.
+	hnext := math.Abs(h)
+	if adaptive {
+		hnext = st.start(sim, sim.State, 4)
+	}
+	states := make([]state.State, 1, sim.Algorithm.Steps+1)
 	states[0] = sim.State.Clone()
-	for i := 0; i < len(states)-1; i++ {
+	tend := states[0].Time() + sim.Dt()
+	for i := 0; sim.stepping(adaptive, i, states[i].Time(), tend); i++ {
 		// create auxiliary states for calculation
 		t := states[i].Time()
+		if adaptive {
+			h = math.Copysign(math.Min(hnext, math.Abs(tend-t)), sim.Dt())
+		}
 		k2, k3, k4, k5, k6, k7, s4, s5, err45 := states[i].CloneBlank(t+c20*h), states[i].CloneBlank(t+c30*h), states[i].CloneBlank(t+c40*h),
 			states[i].CloneBlank(t+c50*h), states[i].CloneBlank(t+c60*h), states[i].CloneBlank(t+c70*h), states[i].CloneBlank(t+h), states[i].CloneBlank(t+h), states[i].CloneBlank(t+h)
 
@@ -295,8 +374,6 @@ func DormandPrinceSolver(sim *Simulation) []state.State {
 		state.AddScaled(s5, b5, k5)
 		state.AddScaled(s5, b6, k6)
 
-		// assign solution
-		states[i+1] = s5.Clone()
 		// Adaptive timestep block. Modify step length if necessary
 		if adaptive {
 			state.AddScaledTo(k7, states[i], c71, k1)
@@ -315,23 +392,34 @@ func DormandPrinceSolver(sim *Simulation) []state.State {
 			state.AddScaled(s4, a6, k6)
 			state.AddScaled(s4, a7, k7)
 			// Error and adaptive timestep implementation
-			state.Abs(state.SubTo(err45, s4, s5))
-			errRatio := sim.Algorithm.Error.Max / state.Max(err45)
-			hnew := math.Min(math.Max(0.9*h*math.Pow(errRatio, .2), sim.Algorithm.Step.Min), sim.Algorithm.Step.Max)
-			sim.Algorithm.Steps = int(math.Max(float64(sim.Algorithm.Steps)*(h/hnew), 1.0))
-			h = hnew
+			state.SubTo(err45, s4, s5)
+			hnew, accept := sim.controlStep(math.Abs(h), sim.errorNorm(err45, states[i], s5), 4)
 			// If we do not have desired error, and have not reached minimum timestep, repeat step
-			if errRatio < 1 && h != sim.Algorithm.Step.Min {
+			if !accept {
+				hnext = hnew
 				i--
 				continue
 			}
+			// a step shortened to land on the interval end does not limit the next step
+			if math.Abs(h) == hnext {
+				hnext = hnew
+			}
 		}
+		// assign solution
+		states = append(states, s5.Clone())
 
 	}
+	if adaptive {
+		st.h = hnext
+	}
 	return states
 }
 
 func RKF78Solver(sim *Simulation) []state.State {
+	return rkf78(sim, &sim.adaptive)
+}
+
+func rkf78(sim *Simulation, st *AdaptiveState) []state.State {
 	// Table X. from Classical Fifth, Sixth, Seventh and Eight Order Runge Kutta Formulas with stepsize control by Erwin Fehlberg.
 	var (
 		cx0 = [13]float64{0, 2. / 27., 1. / 9., 1. / 6., 5. / 12., //4
@@ -352,15 +440,25 @@ func RKF78Solver(sim *Simulation) []state.State {
 		}
 		b = [13]float64{41. / 840., 5: 34. / 105., 9. / 35., 9. / 35., 9. / 280., 9. / 280., 41. / 840.}
 	)
-	adaptive := sim.Algorithm.Error.Max > 0 && sim.Algorithm.Step.Min > 0 && sim.Algorithm.Step.Max > sim.Algorithm.Step.Min
-	states := make([]state.State, sim.Algorithm.Steps+1)
+	adaptive := sim.hasTolerance() && sim.Algorithm.Step.Min > 0 && sim.Algorithm.Step.Max > sim.Algorithm.Step.Min
 	h := sim.Dt() / float64(sim.Algorithm.Steps)
+	// hnext is the step length proposed by the StepController. Adaptive
+	// stepping integrates up to the end of the Timespan interval.
+	hnext := math.Abs(h)
+	if adaptive {
+		hnext = st.start(sim, sim.State, 7)
+	}
+	states := make([]state.State, 1, sim.Algorithm.Steps+1)
 	states[0] = sim.State.Clone()
+	tend := states[0].Time() + sim.Dt()
 	var k [13]state.State
 	var snext, err78 state.State
-	for i := 0; i < len(states)-1; i++ {
+	for i := 0; sim.stepping(adaptive, i, states[i].Time(), tend); i++ {
 		// create auxiliary states for calculation
 		t := states[i].Time()
+		if adaptive {
+			h = math.Copysign(math.Min(hnext, math.Abs(tend-t)), sim.Dt())
+		}
 
 		err78 = states[i].CloneBlank(t + h)
 		snext = states[i].CloneBlank(t + h)
@@ -386,29 +484,33 @@ func RKF78Solver(sim *Simulation) []state.State {
 			state.AddScaled(snext, b[ord], k[ord])
 		}
 
-		// assign solution
-		states[i+1] = snext.Clone()
 		// Adaptive timestep block. Modify step length if necessary
 		if adaptive {
-			errFactor := h * 41. / 840.
+			// k are scaled by step length already
+			errFactor := 41. / 840.
 			state.AddScaled(err78, -errFactor, k[0])
 			state.AddScaled(err78, -errFactor, k[10])
 			state.AddScaled(err78, errFactor, k[11])
 			state.AddScaled(err78, errFactor, k[12])
-			errRatio := sim.Algorithm.Error.Max / state.Max(err78)
-			scale := 0.8 * math.Abs(math.Pow(errRatio, 1./7.))
-			scale = math.Min(math.Max(scale, .125), 4.0)
-			hnew := math.Min(math.Max(h*scale, sim.Algorithm.Step.Min), sim.Algorithm.Step.Max)
-			sim.Algorithm.Steps = int(math.Max(float64(sim.Algorithm.Steps)*(h/hnew), 1.0))
-			h = hnew
+			hnew, accept := sim.controlStep(math.Abs(h), sim.errorNorm(err78, states[i], snext), 7)
 			// If we do not have desired error, and have not reached minimum timestep, repeat step
-			if errRatio < 1 && h != sim.Algorithm.Step.Min {
+			if !accept {
+				hnext = hnew
 				i--
 				continue
 			}
+			// a step shortened to land on the interval end does not limit the next step
+			if math.Abs(h) == hnext {
+				hnext = hnew
+			}
 		}
+		// assign solution
+		states = append(states, snext.Clone())
 
 	}
+	if adaptive {
+		st.h = hnext
+	}
 	return states
 }
 
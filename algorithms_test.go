@@ -1,10 +1,13 @@
 package godesim
 
 import (
+	"errors"
 	"math"
+	"strings"
 	"testing"
 
 	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/mat"
 )
 
 var stiffDiff = map[state.Symbol]state.Diff{
@@ -32,6 +35,234 @@ func TestConvergenceRKF45(t *testing.T) {
 	// fmt.Printf("%.2f\n", tm)
 }
 
+// stiffJacobian is the analytic jacobian of stiffDiff. X symbols are ordered as Dx, x
+func stiffJacobian(dst *mat.Dense, s state.State) {
+	dst.Set(0, 0, 0)
+	dst.Set(0, 1, -50)
+	dst.Set(1, 0, 1)
+	dst.Set(1, 1, 0)
+}
+
+func TestNewtonAnalyticJacobian(t *testing.T) {
+	run := func(jac func(*mat.Dense, state.State)) []float64 {
+		sim := New()
+		sim.Solver = NewtonRaphsonSolver
+		sim.SetTimespan(0, 2., 40)
+		sim.SetDiffFromMap(stiffDiff)
+		sim.SetX0FromMap(stiffX0)
+		if jac != nil {
+			sim.SetJacobian(jac)
+		}
+		sim.Begin()
+		return sim.Results("x")
+	}
+	fdResults, analyticResults := run(nil), run(stiffJacobian)
+	for i := range fdResults {
+		if math.Abs(fdResults[i]-analyticResults[i]) > 1e-5 {
+			t.Errorf("analytic jacobian result %g differs from finite difference result %g", analyticResults[i], fdResults[i])
+		}
+	}
+}
+
+func TestCheckJacobian(t *testing.T) {
+	badJacobian := func(dst *mat.Dense, s state.State) {
+		stiffJacobian(dst, s)
+		dst.Set(0, 1, 50) // wrong sign for d(Dx)/d(x)
+	}
+	sim := New()
+	sim.Solver = NewtonRaphsonSolver
+	sim.SetTimespan(0, 1., 4)
+	sim.SetDiffFromMap(stiffDiff)
+	sim.SetX0FromMap(stiffX0)
+	sim.SetJacobian(badJacobian)
+	sim.Algorithm.Jacobian.Check = true
+	var out = &strings.Builder{}
+	sim.Logger.Output = out
+	sim.Begin()
+	if !strings.Contains(out.String(), "d(Dx)/d(x)") {
+		t.Errorf("expected logged jacobian mismatch for d(Dx)/d(x), got %q", out.String())
+	}
+	x0 := sim.States()[0]
+	mismatches := sim.CheckJacobian(x0)
+	if len(mismatches) != 1 {
+		t.Fatalf("expected 1 jacobian mismatch, got %+v", mismatches)
+	}
+	if m := mismatches[0]; m.Row != "Dx" || m.Col != "x" || m.Analytic != 50 {
+		t.Errorf("unexpected jacobian mismatch %+v", m)
+	}
+	sim.SetJacobian(stiffJacobian)
+	if mismatches = sim.CheckJacobian(x0); len(mismatches) != 0 {
+		t.Errorf("expected no jacobian mismatches, got %+v", mismatches)
+	}
+}
+
+func TestNewtonModified(t *testing.T) {
+	run := func(modified bool) (*Simulation, int) {
+		evals := 0
+		sim := New()
+		sim.Solver = NewtonRaphsonSolver
+		sim.Algorithm.Newton.Tolerance = 1e-8
+		sim.Algorithm.Newton.Modified = modified
+		sim.SetTimespan(0, 2., 100)
+		sim.SetDiffFromMap(stiffDiff)
+		sim.SetX0FromMap(stiffX0)
+		sim.SetJacobian(func(dst *mat.Dense, s state.State) {
+			evals++
+			stiffJacobian(dst, s)
+		})
+		sim.Begin()
+		return sim, evals
+	}
+	full, fullEvals := run(false)
+	modified, modifiedEvals := run(true)
+	if modifiedEvals >= fullEvals/10 {
+		t.Errorf("expected modified newton to reuse jacobian. got %d evaluations, full newton %d", modifiedEvals, fullEvals)
+	}
+	want, got := full.Results("x"), modified.Results("x")
+	for i := range want {
+		if math.Abs(want[i]-got[i]) > 1e-6 {
+			t.Errorf("modified newton got %g, full newton got %g", got[i], want[i])
+		}
+	}
+}
+
+func TestNewtonIterativeLinearSolve(t *testing.T) {
+	diffs, x0, pattern := chainModel(20)
+	// LU, dense GMRES, sparse GMRES and sparse GMRES with analytic jacobian
+	var results [4][]float64
+	for i, direct := range []int{0, 1, 1, 1} {
+		sim := New()
+		sim.Solver = NewtonRaphsonSolver
+		sim.Algorithm.Newton.DirectMax = direct
+		sim.SetDiffFromMap(diffs)
+		sim.SetX0FromMap(x0)
+		if i >= 2 {
+			sim.SetJacobianSparsity(pattern)
+		}
+		if i == 3 {
+			sim.SetJacobian(chainJacobian)
+		}
+		sim.SetTimespan(0, 0.5, 10)
+		sim.Begin()
+		results[i] = sim.Results("c010")
+	}
+	for _, got := range results[1:] {
+		for i := range got {
+			if math.Abs(got[i]-results[0][i]) > 1e-6 {
+				t.Errorf("iterative linear solve got %g, LU got %g", got[i], results[0][i])
+			}
+		}
+	}
+}
+
+func TestNewtonStepRejection(t *testing.T) {
+	sim := New()
+	sim.Solver = NewtonRaphsonSolver
+	sim.Algorithm.Newton.Tolerance = 1e-10
+	sim.Algorithm.IterationMax = 2
+	sim.Algorithm.Newton.FailureEvents = true
+	sim.SetTimespan(0, 1., 5)
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"y": func(s state.State) float64 { return -s.X("y") * s.X("y") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"y": 1})
+	sim.Begin()
+	stats := sim.Stats()
+	if stats.NewtonFailures == 0 || stats.Rejected == 0 {
+		t.Errorf("expected newton failures and rejected steps, got %+v", stats)
+	}
+	if len(sim.Events()) != stats.NewtonFailures {
+		t.Errorf("expected %d failure events, got %d", stats.NewtonFailures, len(sim.Events()))
+	}
+	time, y := sim.Results("time"), sim.Results("y")
+	if len(time) != 6 {
+		t.Errorf("expected rejected steps to keep one result per step, got %d results", len(time))
+	}
+	if math.Abs(time[len(time)-1]-1) > 1e-12 {
+		t.Errorf("expected simulation to end at 1, got %g", time[len(time)-1])
+	}
+	for i := range y {
+		if want := 1 / (1 + time[i]); math.Abs(y[i]-want) > 0.05 {
+			t.Errorf("got y=%g, want %g", y[i], want)
+		}
+	}
+}
+
+// A failed iterative linear solve fails the Newton step so that it is retried.
+func TestNewtonLinearSolveFailure(t *testing.T) {
+	sim := New()
+	sim.Algorithm.Newton.Modified = true
+	sim.SetTimespan(0, 1., 2)
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return -s.X("x") },
+		"y": func(s state.State) float64 { return -s.X("y") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 1, "y": 1})
+	sim.verifyPreBegin()
+	// valid GMRES system whose preconditioner fails
+	ns := newNewtonSystem(sim, 2)
+	ns.direct, ns.valid, ns.h = false, true, 0.5
+	ns.iterative = denseOperator{mat.NewDense(2, 2, []float64{1.5, 0, 0, 1.5})}
+	ns.precon = func(*mat.VecDense, bool, mat.Vector) error { return errors.New("preconditioner failure") }
+	sim.newton = ns
+	_, status := newtonIterate(sim, state.Diffs{sim.Diffs[0], sim.Diffs[1]}, sim.State.Clone(), 0.5)
+	if status != newtonNotConverged {
+		t.Errorf("expected %s, got %s", newtonNotConverged, status)
+	}
+}
+
+func TestNewtonDivergence(t *testing.T) {
+	sim := New()
+	sim.Solver = NewtonRaphsonSolver
+	sim.SetTimespan(0, 1., 5)
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"y": func(s state.State) float64 {
+			if s.Time() > 0.5 {
+				return math.NaN()
+			}
+			return 1
+		},
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"y": 0})
+	err := recoverSimTest(sim)
+	if err == nil || !strings.Contains(err.(error).Error(), "divergence") {
+		t.Errorf("expected divergence panic, got %v", err)
+	}
+	if sim.Stats().NewtonDivergences == 0 {
+		t.Error("expected divergences in stats")
+	}
+}
+
+func TestNewtonAdaptive(t *testing.T) {
+	const tau = -15.
+	sim := New()
+	sim.Solver = NewtonRaphsonSolver
+	sim.Algorithm.Error.Max = 1e-4
+	sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-5, 0.5
+	sim.SetTimespan(0, 1., 4)
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"y": func(s state.State) float64 { return tau * s.X("y") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"y": 1})
+	sim.Begin()
+	time, y := sim.Results("time"), sim.Results("y")
+	if math.Abs(time[len(time)-1]-1) > 1e-12 {
+		t.Errorf("expected simulation to end at 1, got %g", time[len(time)-1])
+	}
+	minStep, maxStep := math.Inf(1), 0.
+	for i := range y {
+		if want := math.Exp(tau * time[i]); math.Abs(y[i]-want) > 5e-3 {
+			t.Errorf("got y=%g, want %g at t=%g", y[i], want, time[i])
+		}
+		if i > 0 {
+			minStep, maxStep = math.Min(minStep, time[i]-time[i-1]), math.Max(maxStep, time[i]-time[i-1])
+		}
+	}
+	if maxStep < 5*minStep {
+		t.Errorf("expected step length to grow as solution decays. got min %g, max %g", minStep, maxStep)
+	}
+}
+
 /*
 // Benchmarks
 */
@@ -0,0 +1,301 @@
+package godesim
+
+import (
+	"math"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Continuation traces a branch of steady states of a simulation as parameter Param
+// varies using pseudo-arclength continuation, which follows the branch around folds.
+// The stability of each point is given by the eigenvalues of the jacobian.
+// Fold bifurcations are detected by a change of direction of Param along the branch
+// and Hopf bifurcations by a pair of complex eigenvalues crossing the imaginary axis.
+//
+// Steps are accepted if the corrector converges within Config.Algorithm.SteadyState settings.
+type Continuation struct {
+	// Param is the continuation parameter, set with SetParamsFromMap.
+	Param state.Symbol
+	// Min and Max limit Param. Continuation ends on the bound the branch reaches.
+	Min, Max float64
+	// Step is the initial and maximum arclength step. Default is (Max-Min)/100.
+	Step float64
+	// Decreasing starts continuation toward decreasing Param values.
+	Decreasing bool
+	// MaxPoints limits the amount of branch points. Default is 1000.
+	MaxPoints int
+}
+
+// BranchPoint is a steady state of a Branch.
+type BranchPoint struct {
+	// Param is the value of the continuation parameter.
+	Param float64
+	// State is the steady state.
+	State       state.State
+	Eigenvalues []complex128
+	Stable      bool
+}
+
+// BifurcationKind identifies a bifurcation.
+type BifurcationKind int
+
+const (
+	// Fold (saddle-node) bifurcations occur where a real eigenvalue crosses zero
+	// and the branch turns back.
+	Fold BifurcationKind = iota
+	// Hopf bifurcations occur where a pair of complex eigenvalues crosses the
+	// imaginary axis, giving rise to oscillations.
+	Hopf
+)
+
+func (k BifurcationKind) String() string {
+	switch k {
+	case Fold:
+		return "fold"
+	case Hopf:
+		return "hopf"
+	}
+	return "unknown"
+}
+
+// Bifurcation is a bifurcation detected between branch points Index-1 and Index.
+type Bifurcation struct {
+	Kind  BifurcationKind
+	Index int
+	// Param and X are located by linear interpolation between branch points.
+	Param float64
+	X     map[state.Symbol]float64
+}
+
+// Branch contains the steady states found by continuation.
+type Branch struct {
+	Param        state.Symbol
+	Points       []BranchPoint
+	Bifurcations []Bifurcation
+}
+
+// Params returns the continuation parameter of each branch point.
+func (b Branch) Params() []float64 {
+	p := make([]float64, len(b.Points))
+	for i := range b.Points {
+		p[i] = b.Points[i].Param
+	}
+	return p
+}
+
+// Values returns the X value of sym at each branch point.
+func (b Branch) Values(sym state.Symbol) []float64 {
+	v := make([]float64, len(b.Points))
+	for i := range b.Points {
+		v[i] = b.Points[i].State.X(sym)
+	}
+	return v
+}
+
+// Run finds a steady state near guess (see FindSteadyState) and continues it.
+func (c Continuation) Run(sim *Simulation, guess map[state.Symbol]float64) Branch {
+	if _, ok := sim.params[c.Param]; !ok {
+		throwf("Continuation: parameter %v not set. Use SetParamsFromMap", c.Param)
+	}
+	if c.Min >= c.Max {
+		throwf("Continuation: Min must be less than Max. got %g, %g", c.Min, c.Max)
+	}
+	p0 := sim.params[c.Param]
+	if p0 < c.Min || p0 > c.Max {
+		throwf("Continuation: %v=%g not within [%g, %g]", c.Param, p0, c.Min, c.Max)
+	}
+	hmax := c.Step
+	if hmax <= 0 {
+		hmax = (c.Max - c.Min) / 100
+	}
+	maxPoints := c.MaxPoints
+	if maxPoints <= 0 {
+		maxPoints = 1000
+	}
+	ss := FindSteadyState(sim, guess)
+	if !ss.Converged {
+		throwf("Continuation: no steady state found near guess. residual %g", ss.Residual)
+	}
+	cs := continuationSolver{sim: sim, param: c.Param, s: ss.State, F: sim.diffsOf(ss.State), n: ss.State.Len()}
+	cs.tol, cs.maxIter = sim.steadyStateLimits()
+	br := Branch{Param: c.Param}
+	y := append(ss.State.XVector(), p0)
+	// initial tangent is oriented along the parameter direction
+	dir := make([]float64, cs.n+1)
+	dir[cs.n] = 1
+	if c.Decreasing {
+		dir[cs.n] = -1
+	}
+	tangent, ok := cs.tangent(y, dir)
+	if !ok {
+		throwf("Continuation: singular jacobian at starting point")
+	}
+	br.Points = append(br.Points, cs.point(y))
+	h := hmax
+	for len(br.Points) < maxPoints {
+		pred := floats.AddScaledTo(make([]float64, len(y)), y, h, tangent)
+		ynew, ok := cs.correct(pred, tangent)
+		if !ok {
+			h /= 2
+			if h < 1e-8*hmax {
+				break
+			}
+			continue
+		}
+		end := ynew[cs.n] < c.Min || ynew[cs.n] > c.Max
+		if end {
+			// last point is corrected with Param fixed on the bound crossed by the step
+			bound := c.Max
+			if ynew[cs.n] < c.Min {
+				bound = c.Min
+			}
+			if y[cs.n] == bound {
+				break
+			}
+			floats.AddScaledTo(pred, y, (bound-y[cs.n])/tangent[cs.n], tangent)
+			pred[cs.n] = bound
+			normal := make([]float64, cs.n+1)
+			normal[cs.n] = 1
+			if ynew, ok = cs.correct(pred, normal); !ok {
+				break
+			}
+		}
+		tnew, ok := cs.tangent(ynew, tangent)
+		if !ok {
+			break
+		}
+		prev := br.Points[len(br.Points)-1]
+		pt := cs.point(ynew)
+		br.Points = append(br.Points, pt)
+		br.detect(len(br.Points)-1, tangent[cs.n], tnew[cs.n], prev, pt)
+		y, tangent = ynew, tnew
+		if end {
+			break
+		}
+		h = math.Min(1.5*h, hmax)
+	}
+	return br
+}
+
+// detect appends bifurcations found between prev and pt, which is at index i.
+// tp0 and tp1 are the parameter components of the tangent at both points.
+func (b *Branch) detect(i int, tp0, tp1 float64, prev, pt BranchPoint) {
+	interp := func(f0, f1 float64) Bifurcation {
+		a := f0 / (f0 - f1)
+		bif := Bifurcation{Index: i, Param: prev.Param + a*(pt.Param-prev.Param), X: make(map[state.Symbol]float64)}
+		for _, sym := range pt.State.XSymbols() {
+			bif.X[sym] = prev.State.X(sym) + a*(pt.State.X(sym)-prev.State.X(sym))
+		}
+		return bif
+	}
+	if tp0*tp1 < 0 {
+		bif := interp(tp0, tp1)
+		bif.Kind = Fold
+		b.Bifurcations = append(b.Bifurcations, bif)
+	}
+	r0, ok0 := maxComplexReal(prev.Eigenvalues)
+	r1, ok1 := maxComplexReal(pt.Eigenvalues)
+	if ok0 && ok1 && r0*r1 < 0 {
+		bif := interp(r0, r1)
+		bif.Kind = Hopf
+		b.Bifurcations = append(b.Bifurcations, bif)
+	}
+}
+
+// maxComplexReal returns the largest real part of eigenvalues with non-zero imaginary part.
+func maxComplexReal(values []complex128) (float64, bool) {
+	max, ok := math.Inf(-1), false
+	for _, v := range values {
+		if imag(v) != 0 && real(v) > max {
+			max, ok = real(v), true
+		}
+	}
+	return max, ok
+}
+
+// continuationSolver solves the extended system of steady states
+// y = (x, p) where p is the continuation parameter.
+type continuationSolver struct {
+	sim     *Simulation
+	param   state.Symbol
+	s       state.State
+	F       state.Diffs
+	n       int
+	tol     float64
+	maxIter int
+}
+
+func (cs *continuationSolver) state(y []float64) state.State {
+	s := cs.s.Clone()
+	s.SetAllX(append([]float64{}, y[:cs.n]...))
+	s.PSet(cs.param, y[cs.n])
+	return s
+}
+
+func (cs *continuationSolver) point(y []float64) BranchPoint {
+	s := cs.state(y)
+	m := EigenModes(cs.sim, s)
+	return BranchPoint{Param: y[cs.n], State: s, Eigenvalues: m.Eigenvalues, Stable: m.Stable()}
+}
+
+// jacobian returns the (n+1)×(n+1) matrix whose first n rows are the
+// jacobian of Diffs with respect to x and p and last row is t.
+func (cs *continuationSolver) jacobian(y, t []float64) *mat.Dense {
+	s := cs.state(y)
+	J := mat.NewDense(cs.n+1, cs.n+1, nil)
+	cs.sim.jacobianOf(J.Slice(0, cs.n, 0, cs.n).(*mat.Dense), cs.F, s)
+	// central difference with respect to parameter
+	p := y[cs.n]
+	dp := 1e-6 * math.Max(1, math.Abs(p))
+	sp, sm := s.Clone(), s.Clone()
+	sp.PSet(cs.param, p+dp)
+	sm.PSet(cs.param, p-dp)
+	for i := range cs.F {
+		J.Set(i, cs.n, (cs.F[i](sp)-cs.F[i](sm))/(2*dp))
+	}
+	J.SetRow(cs.n, t)
+	return J
+}
+
+// tangent returns the unit tangent of the branch at y oriented as dir.
+func (cs *continuationSolver) tangent(y, dir []float64) ([]float64, bool) {
+	rhs := make([]float64, cs.n+1)
+	rhs[cs.n] = 1
+	t, ok := solveDense(cs.jacobian(y, dir), rhs)
+	if !ok {
+		return nil, false
+	}
+	floats.Scale(1/floats.Norm(t, 2), t)
+	if floats.Dot(t, dir) < 0 {
+		floats.Scale(-1, t)
+	}
+	return t, true
+}
+
+// correct solves Diffs(y) = 0 on the hyperplane through pred normal to t with Newton iterations.
+func (cs *continuationSolver) correct(pred, t []float64) ([]float64, bool) {
+	y := append([]float64{}, pred...)
+	G := make([]float64, cs.n+1)
+	for k := 0; k < cs.maxIter; k++ {
+		s := cs.state(y)
+		for i := range cs.F {
+			G[i] = cs.F[i](s)
+		}
+		G[cs.n] = floats.Dot(t, y) - floats.Dot(t, pred)
+		norm := floats.Norm(G, math.Inf(1))
+		if norm <= cs.tol {
+			return y, true
+		}
+		if math.IsNaN(norm) {
+			return nil, false
+		}
+		dy, ok := solveDense(cs.jacobian(y, t), G)
+		if !ok {
+			return nil, false
+		}
+		floats.Sub(y, dy)
+	}
+	return nil, false
+}
@@ -0,0 +1,77 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Steady states of x' = p - x² are x = ±sqrt(p) which meet at a fold at p = 0.
+func TestContinuationFold(t *testing.T) {
+	sim := New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return s.P("p") - s.X("x")*s.X("x") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 1})
+	sim.SetParamsFromMap(map[state.Symbol]float64{"p": 1})
+	br := Continuation{Param: "p", Min: -1, Max: 2, Step: 0.05, Decreasing: true}.Run(sim, nil)
+	if len(br.Bifurcations) != 1 || br.Bifurcations[0].Kind != Fold {
+		t.Fatalf("expected a single fold, got %+v", br.Bifurcations)
+	}
+	fold := br.Bifurcations[0]
+	if math.Abs(fold.Param) > 1e-3 || math.Abs(fold.X["x"]) > 0.05 {
+		t.Errorf("expected fold at p=0, x=0. got p=%g, x=%g", fold.Param, fold.X["x"])
+	}
+	p, x := br.Params(), br.Values("x")
+	for i, pt := range br.Points {
+		if math.Abs(x[i]*x[i]-p[i]) > 1e-8 {
+			t.Errorf("point %d (p=%g, x=%g) not a steady state", i, p[i], x[i])
+		}
+		// upper branch is stable
+		if pt.Stable != (x[i] > 0) && math.Abs(x[i]) > 1e-6 {
+			t.Errorf("point %d (p=%g, x=%g) stability %t", i, p[i], x[i], pt.Stable)
+		}
+	}
+	if last := br.Points[len(br.Points)-1]; math.Abs(last.Param-2) > 1e-8 || last.State.X("x") > 0 {
+		t.Errorf("expected branch to return along lower branch to p=2, ended at p=%g, x=%g", last.Param, last.State.X("x"))
+	}
+}
+
+// The steady state (a, b/a) of the Brusselator loses stability
+// at a Hopf bifurcation at b = 1 + a².
+func TestContinuationHopf(t *testing.T) {
+	const a = 1.
+	sim := New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 {
+			x, y := s.X("x"), s.X("y")
+			return a + x*x*y - (s.P("b")+1)*x
+		},
+		"y": func(s state.State) float64 {
+			x, y := s.X("x"), s.X("y")
+			return s.P("b")*x - x*x*y
+		},
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 1, "y": 1})
+	sim.SetParamsFromMap(map[state.Symbol]float64{"b": 1})
+	br := Continuation{Param: "b", Min: 0.5, Max: 3}.Run(sim, nil)
+	if len(br.Bifurcations) != 1 || br.Bifurcations[0].Kind != Hopf {
+		t.Fatalf("expected a single hopf bifurcation, got %+v", br.Bifurcations)
+	}
+	hopf := br.Bifurcations[0]
+	if math.Abs(hopf.Param-(1+a*a)) > 1e-6 || math.Abs(hopf.X["y"]-hopf.Param/a) > 1e-6 {
+		t.Errorf("expected hopf at b=%g, got b=%g, y=%g", 1+a*a, hopf.Param, hopf.X["y"])
+	}
+	for i, p := range br.Params() {
+		if p < 0.5 || p > 3+1e-8 {
+			t.Errorf("point %d at b=%g outside of [0.5, 3]", i, p)
+		}
+	}
+	if last := br.Points[len(br.Points)-1]; math.Abs(last.Param-3) > 1e-8 {
+		t.Errorf("expected branch to end at b=3, got %g", last.Param)
+	}
+	if !br.Points[0].Stable || br.Points[len(br.Points)-1].Stable {
+		t.Error("expected stable steady states before hopf and unstable after")
+	}
+}
@@ -0,0 +1,220 @@
+package godesim
+
+import (
+	"math"
+	"reflect"
+
+	"github.com/soypat/godesim/state"
+)
+
+// StepController proposes step lengths for adaptive solvers based on the
+// normalized error of the last step. A normalized error not greater than 1
+// is within tolerance (see Config.Algorithm.Error).
+//
+// Controllers may keep a history of errors so each Simulation should have it's own.
+type StepController interface {
+	// Step receives the length h and normalized error errNorm of the last step
+	// and returns the length of the next step and whether the last step is accepted.
+	// order is the order of the method's error estimate, which is proportional to h^(order+1).
+	Step(h, errNorm float64, order int) (hnew float64, accept bool)
+	// Reset clears error history. Called on Simulation.Begin
+	Reset()
+}
+
+// ControllerFactors limit the step length change proposed by a StepController.
+// Zero values are replaced by defaults.
+type ControllerFactors struct {
+	// Safety multiplies the proposed step length. Default is 0.9.
+	Safety float64 `yaml:"safety"`
+	// MinGrowth and MaxGrowth limit the ratio between the next and
+	// last step length. Defaults are 0.2 and 5.
+	MinGrowth float64 `yaml:"min_growth"`
+	MaxGrowth float64 `yaml:"max_growth"`
+	// RejectShrink is the largest ratio between the next and last step
+	// length when a step is rejected. Default is 1.
+	RejectShrink float64 `yaml:"reject_shrink"`
+}
+
+// factor applies limits to ratio between new and last step length.
+func (f ControllerFactors) factor(ratio float64, accept bool) float64 {
+	safety, minGrowth, maxGrowth, shrink := f.Safety, f.MinGrowth, f.MaxGrowth, f.RejectShrink
+	if safety <= 0 {
+		safety = 0.9
+	}
+	if minGrowth <= 0 {
+		minGrowth = 0.2
+	}
+	if maxGrowth <= 0 {
+		maxGrowth = 5
+	}
+	if shrink <= 0 {
+		shrink = 1
+	}
+	ratio = math.Min(math.Max(safety*ratio, minGrowth), maxGrowth)
+	if !accept {
+		ratio = math.Min(ratio, shrink)
+	}
+	return ratio
+}
+
+// errPow returns err^(-beta/k) guarding against zero errors.
+func errPow(err, beta, k float64) float64 {
+	if err <= 0 {
+		return math.Inf(1)
+	}
+	return math.Pow(err, -beta/k)
+}
+
+// IController is the classic integral controller used by most
+// embedded Runge-Kutta implementations:
+//  hnew = h * Safety * err^(-1/(order+1))
+type IController struct {
+	ControllerFactors
+}
+
+// Step implements StepController
+func (c *IController) Step(h, errNorm float64, order int) (float64, bool) {
+	accept := errNorm <= 1
+	return h * c.factor(errPow(errNorm, 1, float64(order+1)), accept), accept
+}
+
+// Reset implements StepController. IController has no history.
+func (c *IController) Reset() {}
+
+// PIController is Gustafsson's proportional-integral controller which
+// smooths step length changes using the error of the last accepted step:
+//  hnew = h * Safety * err^(-Alpha/(order+1)) * errPrev^(Beta/(order+1))
+// Rejected steps are controlled like the IController.
+type PIController struct {
+	ControllerFactors
+	// Alpha and Beta are the controller gains. Defaults are 0.7 and 0.4
+	Alpha, Beta float64
+	errPrev     float64
+}
+
+// Step implements StepController
+func (c *PIController) Step(h, errNorm float64, order int) (float64, bool) {
+	alpha, beta := c.Alpha, c.Beta
+	if alpha == 0 && beta == 0 {
+		alpha, beta = 0.7, 0.4
+	}
+	k := float64(order + 1)
+	if errNorm > 1 {
+		return h * c.factor(errPow(errNorm, 1, k), false), false
+	}
+	ratio := errPow(errNorm, alpha, k)
+	if c.errPrev > 0 {
+		ratio /= errPow(c.errPrev, beta, k)
+	}
+	c.errPrev = math.Max(errNorm, 1e-4)
+	return h * c.factor(ratio, true), true
+}
+
+// Reset implements StepController
+func (c *PIController) Reset() { c.errPrev = 0 }
+
+// PIDController is Söderlind's proportional-integral-derivative controller
+// using the errors of the last three accepted steps:
+//  hnew = h * Safety * err^(-Beta1/k) * errPrev^(-Beta2/k) * errPrev2^(-Beta3/k)
+// where k = order+1. Rejected steps are controlled like the IController.
+type PIDController struct {
+	ControllerFactors
+	// Beta1, Beta2 and Beta3 are the controller gains. Defaults are 0.49, -0.34 and 0.10
+	Beta1, Beta2, Beta3 float64
+	errs                [2]float64
+}
+
+// Step implements StepController
+func (c *PIDController) Step(h, errNorm float64, order int) (float64, bool) {
+	b1, b2, b3 := c.Beta1, c.Beta2, c.Beta3
+	if b1 == 0 && b2 == 0 && b3 == 0 {
+		b1, b2, b3 = 0.49, -0.34, 0.10
+	}
+	k := float64(order + 1)
+	if errNorm > 1 {
+		return h * c.factor(errPow(errNorm, 1, k), false), false
+	}
+	ratio := errPow(errNorm, b1, k)
+	if c.errs[0] > 0 {
+		ratio *= errPow(c.errs[0], b2, k)
+	}
+	if c.errs[1] > 0 {
+		ratio *= errPow(c.errs[1], b3, k)
+	}
+	c.errs[1], c.errs[0] = c.errs[0], math.Max(errNorm, 1e-4)
+	return h * c.factor(ratio, true), true
+}
+
+// Reset implements StepController
+func (c *PIDController) Reset() { c.errs = [2]float64{} }
+
+// copyController returns a copy of c with it's configuration so that another
+// Simulation may use it without sharing error history. Controllers which
+// are not pointers are returned as is.
+func copyController(c StepController) StepController {
+	v := reflect.ValueOf(c)
+	if c == nil || v.Kind() != reflect.Ptr || v.IsNil() {
+		return c
+	}
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+	return cp.Interface().(StepController)
+}
+
+// controlStep proposes next step length with simulation's StepController,
+// bounded by Config.Algorithm.Step limits. Steps at the minimum step length are always accepted.
+func (sim *Simulation) controlStep(h, errNorm float64, order int) (hnew float64, accept bool) {
+	if sim.StepController == nil {
+		sim.StepController = &IController{}
+	}
+	if math.IsNaN(errNorm) {
+		throwf("adaptive step: error estimate is NaN at %s=%g with step %g", sim.Domain, sim.State.Time(), h)
+	}
+	hnew, accept = sim.StepController.Step(h, errNorm, order)
+	hnew = math.Min(math.Max(hnew, sim.Algorithm.Step.Min), sim.Algorithm.Step.Max)
+	if math.IsNaN(hnew) || math.IsInf(hnew, 0) {
+		throwf("adaptive step: step controller proposed step %g at %s=%g", hnew, sim.Domain, sim.State.Time())
+	}
+	if !accept && h <= sim.Algorithm.Step.Min {
+		accept = true
+	}
+	if !accept {
+		sim.stats.Rejected++
+	}
+	return hnew, accept
+}
+
+// initialStep estimates the step length an adaptive solver of given order
+// should start with at state s from the norms of the state and it's derivatives.
+// See Hairer, Nørsett & Wanner, Solving Ordinary Differential Equations I, section II.4.
+func (sim *Simulation) initialStep(s state.State, order int) float64 {
+	f0 := StateDiff(sim.Diffs, s)
+	d0, d1 := sim.errorNorm(s, s, s), sim.errorNorm(f0, s, s)
+	h0 := 1e-6
+	if d0 >= 1e-5 && d1 >= 1e-5 {
+		h0 = 0.01 * d0 / d1
+	}
+	// derivative change over an explicit Euler step estimates second derivative
+	step := math.Copysign(h0, sim.Dt())
+	s1 := s.CloneBlank(s.Time() + step)
+	state.AddScaledTo(s1, s, step, f0)
+	df := StateDiff(sim.Diffs, s1)
+	state.Sub(df, f0)
+	d2 := sim.errorNorm(df, s, s) / h0
+	h1 := math.Max(1e-6, h0*1e-3)
+	if dmax := math.Max(d1, d2); dmax > 1e-15 {
+		h1 = math.Pow(0.01/dmax, 1/float64(order+1))
+	}
+	h := math.Min(100*h0, h1)
+	return math.Min(math.Max(h, sim.Algorithm.Step.Min), math.Min(sim.Algorithm.Step.Max, math.Abs(sim.Dt())))
+}
+
+// stepping returns true if a solver which has taken i steps and is at time t
+// has not yet reached the end of the current Timespan interval at tend.
+// Adaptive solvers step up to tend, otherwise Config.Algorithm.Steps steps are taken.
+func (sim *Simulation) stepping(adaptive bool, i int, t, tend float64) bool {
+	if !adaptive {
+		return i < sim.Algorithm.Steps
+	}
+	return math.Abs(tend-t) > 1e-9*math.Abs(sim.Dt())
+}
@@ -0,0 +1,89 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+)
+
+func TestStepControllerFactors(t *testing.T) {
+	c := &IController{ControllerFactors{MaxGrowth: 2, RejectShrink: 0.5}}
+	if h, accept := c.Step(1, 0, 4); !accept || h != 2 {
+		t.Errorf("zero error: got h=%g accept=%t, want 2, true", h, accept)
+	}
+	if h, accept := c.Step(1, 1.01, 4); accept || h != 0.5 {
+		t.Errorf("rejected step: got h=%g accept=%t, want 0.5, false", h, accept)
+	}
+	if h, _ := c.Step(1, 1e10, 4); h != 0.2 {
+		t.Errorf("min growth: got h=%g, want 0.2", h)
+	}
+}
+
+// All controllers integrate within tolerance with every embedded solver.
+func TestStepControllers(t *testing.T) {
+	const omega = 4.
+	for _, ctl := range []struct {
+		name string
+		c    StepController
+	}{{"I", &IController{}}, {"PI", &PIController{}}, {"PID", &PIDController{}}} {
+		for _, solver := range []struct {
+			name string
+			f    func(*Simulation) []state.State
+		}{{"rkf45", RKF45Solver}, {"dormandPrince", DormandPrinceSolver}, {"rkf78", RKF78Solver}} {
+			sim := New()
+			sim.Solver = solver.f
+			sim.StepController = ctl.c
+			sim.Algorithm.Error.RelTol, sim.Algorithm.Error.AbsTol = 1e-7, 1e-7
+			sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-6, 1
+			sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+				"x":  func(s state.State) float64 { return s.X("Dx") },
+				"Dx": func(s state.State) float64 { return -omega * omega * s.X("x") },
+			})
+			sim.SetX0FromMap(map[state.Symbol]float64{"x": 1, "Dx": 0})
+			sim.SetTimespan(0, 5, 10)
+			sim.Begin()
+			time, x := sim.Results("time"), sim.Results("x")
+			for i := range x {
+				if want := math.Cos(omega * time[i]); math.Abs(x[i]-want) > 1e-4 {
+					t.Errorf("%s/%s: got x=%g, want %g", ctl.name, solver.name, x[i], want)
+					break
+				}
+			}
+		}
+	}
+}
+
+// Fast decay integrated over a single long output interval.
+// The initial step length must be in the scale of the decay.
+func TestInitialStep(t *testing.T) {
+	const k = 1e3
+	for _, solver := range []struct {
+		name string
+		f    func(*Simulation) []state.State
+	}{{"rkf45", RKF45Solver}, {"dormandPrince", DormandPrinceSolver}, {"rkf78", RKF78Solver}} {
+		sim := New()
+		sim.Solver = solver.f
+		sim.Algorithm.Error.RelTol, sim.Algorithm.Error.AbsTol = 1e-6, 1e-9
+		sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-12, 1
+		sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+			"x": func(s state.State) float64 { return -k * s.X("x") },
+		})
+		sim.SetX0FromMap(map[state.Symbol]float64{"x": 1})
+		sim.SetTimespan(0, 1, 1)
+		sim.Begin()
+		time, x := sim.Results("time"), sim.Results("x")
+		if h := time[1] - time[0]; h > 1/k || h < 1e-9 {
+			t.Errorf("%s: first step length %g not in scale of dynamics", solver.name, h)
+		}
+		if end := time[len(time)-1]; end != 1 {
+			t.Errorf("%s: expected integration to end at 1, got %g", solver.name, end)
+		}
+		for i := range x {
+			if want := math.Exp(-k * time[i]); math.Abs(x[i]-want) > 1e-5 {
+				t.Errorf("%s: got x=%g, want %g at time %g", solver.name, x[i], want, time[i])
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package godesim
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/stat"
+)
+
+// Sampler draws a random value using rnd.
+type Sampler func(rnd *rand.Rand) float64
+
+// Uniform returns a Sampler of the uniform distribution in [min, max).
+func Uniform(min, max float64) Sampler {
+	return func(rnd *rand.Rand) float64 { return min + (max-min)*rnd.Float64() }
+}
+
+// Normal returns a Sampler of the normal distribution.
+func Normal(mean, std float64) Sampler {
+	return func(rnd *rand.Rand) float64 { return mean + std*rnd.NormFloat64() }
+}
+
+// Ensemble runs a model many times with randomly sampled parameters
+// and initial conditions and gathers statistics of the results.
+//
+// Simulations are run concurrently so Model must not return
+// Simulations which share mutable data such as Eventers. Pointer
+// Integrators and StepControllers are copied for each run.
+type Ensemble struct {
+	// Model returns a Simulation ready to Begin for the sampled parameters.
+	// Parameters set with Simulation.SetParamsFromMap are overridden by sampled values.
+	Model func(params map[state.Symbol]float64) *Simulation
+	// Params samplers draw the parameters passed to Model.
+	Params map[state.Symbol]Sampler
+	// X0 samplers draw initial X values, which are set after calling Model.
+	X0 map[state.Symbol]Sampler
+	// Runs is the amount of simulations run.
+	Runs int
+	// Workers is the amount of simulations run concurrently.
+	// Default is runtime.GOMAXPROCS(0).
+	Workers int
+	// Seed of the random number generator. Ensembles with the same
+	// seed yield the same results regardless of Workers.
+	Seed int64
+}
+
+// EnsembleResults contains the results of all ensemble runs linearly
+// interpolated onto the Timespan points of the first successful run.
+// Runs which end before a point have NaN values, which are
+// ignored by statistics.
+type EnsembleResults struct {
+	// Time contains the output points.
+	Time []float64
+	// Params contains the sampled parameters of each run.
+	Params []map[state.Symbol]float64
+	// Errors contains the panic of each failed run as an error. nil for successful runs.
+	Errors []error
+	// values contains interpolated results of each symbol indexed by run and then time. nil for failed runs.
+	values map[state.Symbol][][]float64
+}
+
+// Run runs the ensemble simulations. Panics of individual runs are
+// recovered and stored in EnsembleResults.Errors.
+func (e Ensemble) Run() *EnsembleResults {
+	if e.Model == nil {
+		throwf("Ensemble: Model not set")
+	}
+	if e.Runs < 1 {
+		throwf("Ensemble: Runs must be at least 1. got %d", e.Runs)
+	}
+	// each run draws from it's own source so results do not depend on scheduling
+	seeds := make([]int64, e.Runs)
+	rnd := rand.New(rand.NewSource(e.Seed))
+	for i := range seeds {
+		seeds[i] = rnd.Int63()
+	}
+	runs := make([]ensembleRun, e.Runs)
+	parallel(e.Runs, e.Workers, func(i int) {
+		runs[i] = e.run(i, rand.New(rand.NewSource(seeds[i])))
+	})
+	return gatherEnsemble(runs)
+}
+
+// parallel calls f for i in [0, n) using workers goroutines.
+// Default amount of workers is runtime.GOMAXPROCS(0).
+func parallel(n, workers int, f func(i int)) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// isolate copies sim's pointer Integrator and StepController so that
+// it does not share step length state with other simulations.
+func (sim *Simulation) isolate() {
+	sim.Integrator = copySolver(sim.Integrator)
+	sim.StepController = copyController(sim.StepController)
+}
+
+// ensembleRun holds the raw results of a single run
+type ensembleRun struct {
+	params map[state.Symbol]float64
+	grid   []float64
+	time   []float64
+	values map[state.Symbol][]float64
+	err    error
+}
+
+func (e Ensemble) run(i int, rnd *rand.Rand) (r ensembleRun) {
+	r.params = make(map[state.Symbol]float64, len(e.Params))
+	for _, sym := range sortedSamplerSymbols(e.Params) {
+		r.params[sym] = e.Params[sym](rnd)
+	}
+	x0 := make(map[state.Symbol]float64, len(e.X0))
+	for _, sym := range sortedSamplerSymbols(e.X0) {
+		x0[sym] = e.X0[sym](rnd)
+	}
+	defer func() {
+		if a := recover(); a != nil {
+			r.err = fmt.Errorf("ensemble run %d: %v", i, a)
+		}
+	}()
+	sim := e.Model(r.params)
+	sim.isolate()
+	sim.overrideParams(r.params)
+	for sym, v := range x0 {
+		sim.State.XSet(sym, v)
+	}
+	r.grid = sim.Timespan.grid()
+	sim.Begin()
+	r.time = sim.Results(sim.Domain)
+	syms := append(sim.State.XSymbols(), sim.State.USymbols()...)
+	r.values = make(map[state.Symbol][]float64, len(syms))
+	for _, sym := range syms {
+		r.values[sym] = sim.Results(sym)
+	}
+	return r
+}
+
+func gatherEnsemble(runs []ensembleRun) *EnsembleResults {
+	res := &EnsembleResults{
+		Params: make([]map[state.Symbol]float64, len(runs)),
+		Errors: make([]error, len(runs)),
+		values: make(map[state.Symbol][][]float64),
+	}
+	for i, r := range runs {
+		res.Params[i] = r.params
+		res.Errors[i] = r.err
+		if r.err == nil && res.Time == nil {
+			res.Time = r.grid
+		}
+	}
+	for i, r := range runs {
+		if r.err != nil {
+			continue
+		}
+		for sym, v := range r.values {
+			if res.values[sym] == nil {
+				res.values[sym] = make([][]float64, len(runs))
+			}
+			res.values[sym][i] = interpolate(res.Time, r.time, v)
+		}
+	}
+	return res
+}
+
+// interpolate linearly interpolates y(x) at points xi. x must be monotonic.
+// Points outside of x yield NaN.
+func interpolate(xi, x, y []float64) []float64 {
+	yi := make([]float64, len(xi))
+	dir := 1.
+	if len(x) > 1 && x[len(x)-1] < x[0] {
+		dir = -1
+	}
+	for i, p := range xi {
+		// first result at or past p
+		k := sort.Search(len(x), func(j int) bool { return dir*(x[j]-p) >= 0 })
+		switch {
+		case k == len(x):
+			yi[i] = math.NaN()
+			// last result may fall short of the end by rounding errors
+			if len(x) > 1 && math.Abs(x[k-1]-p) <= 1e-9*math.Abs(x[k-1]-x[0]) {
+				yi[i] = y[k-1]
+			}
+		case x[k] == p:
+			yi[i] = y[k]
+		case k == 0:
+			yi[i] = math.NaN()
+		default:
+			yi[i] = y[k-1] + (y[k]-y[k-1])*(p-x[k-1])/(x[k]-x[k-1])
+		}
+	}
+	return yi
+}
+
+// Values returns the interpolated results of sym indexed by run and then time.
+// Failed runs are nil.
+func (res *EnsembleResults) Values(sym state.Symbol) [][]float64 {
+	v, ok := res.values[sym]
+	if !ok {
+		throwf("EnsembleResults: %s not found in results", sym)
+	}
+	return v
+}
+
+// Mean returns the mean of sym over successful runs at each output point.
+func (res *EnsembleResults) Mean(sym state.Symbol) []float64 {
+	return res.reduce(sym, func(x []float64) float64 { return stat.Mean(x, nil) })
+}
+
+// Std returns the sample standard deviation of sym over successful
+// runs at each output point.
+func (res *EnsembleResults) Std(sym state.Symbol) []float64 {
+	return res.reduce(sym, func(x []float64) float64 { return stat.StdDev(x, nil) })
+}
+
+// Quantile returns the p quantile of sym over successful runs at each output point.
+// A band containing 90% of runs is given by the 0.05 and 0.95 quantiles.
+func (res *EnsembleResults) Quantile(sym state.Symbol, p float64) []float64 {
+	if p < 0 || p > 1 {
+		throwf("EnsembleResults: quantile %g not in [0, 1]", p)
+	}
+	return res.reduce(sym, func(x []float64) float64 {
+		sort.Float64s(x)
+		return stat.Quantile(p, stat.Empirical, x, nil)
+	})
+}
+
+// reduce applies f to the non NaN values of each output point. NaN if there are none.
+func (res *EnsembleResults) reduce(sym state.Symbol, f func(x []float64) float64) []float64 {
+	runs := res.Values(sym)
+	out := make([]float64, len(res.Time))
+	x := make([]float64, 0, len(runs))
+	for i := range out {
+		x = x[:0]
+		for _, v := range runs {
+			if v != nil && !math.IsNaN(v[i]) {
+				x = append(x, v[i])
+			}
+		}
+		out[i] = math.NaN()
+		if len(x) > 0 {
+			out[i] = f(x)
+		}
+	}
+	return out
+}
+
+func sortedSamplerSymbols(m map[state.Symbol]Sampler) []state.Symbol {
+	syms := make([]state.Symbol, 0, len(m))
+	for sym := range m {
+		syms = append(syms, sym)
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i] < syms[j] })
+	return syms
+}
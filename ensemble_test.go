@@ -0,0 +1,116 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Exponential decay with uniformly distributed rate and
+// normally distributed initial value.
+func decayEnsemble(workers int) Ensemble {
+	return Ensemble{
+		Model: func(p map[state.Symbol]float64) *Simulation {
+			k := p["k"]
+			if k > 1.95 {
+				panic("rate too high")
+			}
+			sim := New()
+			sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+				"x": func(s state.State) float64 { return -k * s.X("x") },
+			})
+			sim.SetX0FromMap(map[state.Symbol]float64{"x": 1})
+			sim.Algorithm.Steps = 5
+			sim.SetTimespan(0, 2, 10)
+			return sim
+		},
+		Params:  map[state.Symbol]Sampler{"k": Uniform(1, 2)},
+		X0:      map[state.Symbol]Sampler{"x": Normal(1, 0.1)},
+		Runs:    400,
+		Workers: workers,
+		Seed:    1,
+	}
+}
+
+func TestEnsemble(t *testing.T) {
+	res := decayEnsemble(4).Run()
+	if len(res.Time) != 11 {
+		t.Fatalf("expected 11 output points, got %d", len(res.Time))
+	}
+	failed := 0
+	for i, err := range res.Errors {
+		if (err != nil) != (res.Params[i]["k"] > 1.95) {
+			t.Errorf("run %d with k=%g: unexpected error %v", i, res.Params[i]["k"], err)
+		}
+		if err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Error("expected failed runs")
+	}
+	mean, std := res.Mean("x"), res.Std("x")
+	lo, hi := res.Quantile("x", 0.05), res.Quantile("x", 0.95)
+	for i, time := range res.Time {
+		// expected value of x0*exp(-k*t) for k uniform in [1, 1.95]
+		want := 1.
+		if time > 0 {
+			want = (math.Exp(-time) - math.Exp(-1.95*time)) / (0.95 * time)
+		}
+		if math.Abs(mean[i]-want) > 4*std[i]/math.Sqrt(float64(len(res.Errors)-failed)) {
+			t.Errorf("mean at %g: got %g, want %g", time, mean[i], want)
+		}
+		if !(lo[i] < mean[i] && mean[i] < hi[i]) {
+			t.Errorf("mean %g not within quantile band [%g, %g]", mean[i], lo[i], hi[i])
+		}
+	}
+	// same seed must give same results regardless of worker count
+	serial := decayEnsemble(1).Run().Values("x")
+	for i, run := range res.Values("x") {
+		for j := range run {
+			if run[j] != serial[i][j] {
+				t.Fatalf("run %d differs between parallel and serial ensembles", i)
+			}
+		}
+	}
+}
+
+// Runs of Models sharing a stateful Integrator and StepController
+// must not modify them.
+func TestEnsembleIsolation(t *testing.T) {
+	integrator, controller := &RKF45{}, &PIController{}
+	e := decayEnsemble(4)
+	model := e.Model
+	e.Model = func(p map[state.Symbol]float64) *Simulation {
+		sim := model(p)
+		sim.Integrator, sim.StepController = integrator, controller
+		sim.Algorithm.Error.AbsTol = 1e-6
+		sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-4, 0.1
+		return sim
+	}
+	res := e.Run()
+	if integrator.StepLength() != 0 || controller.errPrev != 0 {
+		t.Errorf("shared integrator or step controller modified by ensemble runs")
+	}
+	if mean := res.Mean("x"); math.IsNaN(mean[len(mean)-1]) {
+		t.Error("expected results of successful runs")
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	x, y := []float64{0, 1, 3}, []float64{0, 2, 6}
+	got := interpolate([]float64{-1, 0, 0.5, 2, 3, 4}, x, y)
+	want := []float64{math.NaN(), 0, 1, 4, 6, math.NaN()}
+	for i := range want {
+		if got[i] != want[i] && !(math.IsNaN(got[i]) && math.IsNaN(want[i])) {
+			t.Errorf("interpolate: got %v, want %v", got, want)
+			break
+		}
+	}
+	// backward
+	got = interpolate([]float64{3, 2, 0}, []float64{3, 1, 0}, []float64{6, 2, 0})
+	if got[1] != 4 {
+		t.Errorf("backward interpolate: got %v, want 4 at 2", got)
+	}
+}
@@ -2,6 +2,7 @@ package godesim
 
 import (
 	"math"
+	"strings"
 	"testing"
 
 	"github.com/soypat/godesim/state"
@@ -275,3 +276,34 @@ func TestEventErrors(t *testing.T) {
 	sim.Begin()
 
 }
+
+func TestStepLenPointTimespan(t *testing.T) {
+	sim := New()
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 0})
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return 1 },
+	})
+	points := []float64{0, 0.1, 0.5, 1}
+	sim.SetTimespanPoints(points)
+	sim.Logger.Output = &strings.Builder{}
+	sim.AddEventHandlers(TypicalEventer{
+		label: "refine",
+		action: func(s state.State) func(*Simulation) error {
+			return NewStepLength(0.01)
+		},
+	})
+	sim.Begin()
+	if evs := sim.Events(); len(evs) != 1 || !strings.Contains(evs[0].Label, "explicit points") {
+		t.Errorf("expected NewStepLength error event, got %+v", evs)
+	}
+	time := sim.Results("time")
+	if len(time) != len(points) {
+		t.Fatalf("expected results at timespan points %v, got %v", points, time)
+	}
+	for i := range points {
+		if math.Abs(time[i]-points[i]) > 1e-12 {
+			t.Errorf("expected results at timespan points %v, got %v", points, time)
+			break
+		}
+	}
+}
@@ -37,7 +37,8 @@ func DiffChangeFromMap(newDiff map[state.Symbol]func(state.State) float64) func(
 		applied := 0
 		for i, sym := range sim.State.XSymbols() {
 			if _, ok := newDiff[sym]; ok {
-				sim.Diffs[i] = newDiff[sym]
+				sim.Diffs[i] = sim.countedDiff(newDiff[sym])
+				sim.diffsChanged = true
 				applied++
 			}
 		}
@@ -48,10 +49,37 @@ func DiffChangeFromMap(newDiff map[state.Symbol]func(state.State) float64) func(
 	}
 }
 
-// NewStepLength Event handler. Sets the new minimum step length
+// ParamChangeFromMap Event handler. Sets new values of existing parameters (P).
+// Results before the event keep the previous values.
+func ParamChangeFromMap(newParams map[state.Symbol]float64) func(*Simulation) error {
+	return func(sim *Simulation) error {
+		// last result shares P with State
+		s := sim.State.Clone()
+		applied := 0
+		for _, sym := range s.PSymbols() {
+			if v, ok := newParams[sym]; ok {
+				s.PSet(sym, v)
+				applied++
+			}
+		}
+		sim.State = s
+		if applied != len(newParams) {
+			return fmt.Errorf("%d symbol(s) were not found during ParamChange event", len(newParams)-applied)
+		}
+		return nil
+	}
+}
+
+// NewStepLength Event handler. Sets the new minimum step length.
+// h is positive for backward simulations too. Returns an error for
+// timespans with explicit points, which are left unchanged.
 func NewStepLength(h float64) func(*Simulation) error {
 	return func(sim *Simulation) error {
+		if sim.Timespan.points != nil {
+			return fmt.Errorf("NewStepLength: timespan has explicit points")
+		}
 		if sim.IsRunning() {
+			h := math.Copysign(h, sim.Dt())
 			steps := math.Ceil((sim.End() - sim.CurrentTime()) / h)
 
 			sim.SetTimespan(sim.CurrentTime(), sim.CurrentTime()+steps*h, int(steps))
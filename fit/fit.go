@@ -0,0 +1,315 @@
+// Package fit estimates godesim model parameters from measured data
+// by repeatedly simulating the model and minimizing a loss with gonum/optimize.
+package fit
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/soypat/godesim"
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/diff/fd"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/optimize"
+)
+
+// Data contains measurements of an X, U or P symbol.
+type Data struct {
+	Symbol state.Symbol
+	// Time contains the domain values of the measurements, which must lie within
+	// the simulated domain. Simulation results are linearly interpolated at these points
+	// so they are best included in the Simulation's Timespan.
+	Time   []float64
+	Values []float64
+	// Weights of each measurement, typically 1/σ² for measurement standard deviation σ.
+	// nil weights all measurements equally.
+	Weights []float64
+}
+
+// Param is a free parameter. Bounds are enforced by a change of variables,
+// so Init must lie strictly within them. Infinite bounds are used for one sided
+// bounds and unbounded parameters, i.e.
+//  fit.Param{Symbol: "k", Init: 1, Min: math.Inf(-1), Max: math.Inf(1)}
+type Param struct {
+	Symbol   state.Symbol
+	Init     float64
+	Min, Max float64
+}
+
+// Loss returns the loss of residuals (simulated minus measured) with weights.
+type Loss func(residuals, weights []float64) float64
+
+// LeastSquares is the weighted sum of squared residuals.
+func LeastSquares(residuals, weights []float64) float64 {
+	sum := 0.
+	for i, r := range residuals {
+		sum += weights[i] * r * r
+	}
+	return sum
+}
+
+// Problem is a parameter estimation problem.
+type Problem struct {
+	// Model returns a Simulation ready to Begin for the given parameters. Parameters set
+	// with Simulation.SetParamsFromMap are overridden by the estimated values.
+	Model  func(params map[state.Symbol]float64) *godesim.Simulation
+	Data   []Data
+	Params []Param
+	// Loss is minimized over the parameters. Default is LeastSquares.
+	Loss Loss
+	// Method is the optimization method. Default is optimize.NelderMead, which
+	// requires no gradient. The gradient of gradient based methods is
+	// approximated with finite differences.
+	Method optimize.Method
+	// Settings of the optimization. May be nil.
+	Settings *optimize.Settings
+}
+
+// Result contains the parameter estimates.
+type Result struct {
+	// Params contains the estimated parameters.
+	Params map[state.Symbol]float64
+	// Loss is the loss at the estimated parameters.
+	Loss float64
+	// Residuals contains simulated minus measured values for each Data series, in order.
+	Residuals [][]float64
+	// Covariance is the Gauss-Newton estimate of the parameter covariance
+	//  s² * (JᵀWJ)⁻¹,  s² = Σ w*r² / (measurements - parameters)
+	// where J is the jacobian of residuals with respect to parameters. Rows and columns
+	// follow the order of Problem.Params. Meaningful for least squares losses and
+	// contains NaN values if JᵀWJ is singular or there are too few measurements.
+	Covariance *mat.SymDense
+	// StdErr contains the standard error of each parameter, the square root of the covariance diagonal.
+	StdErr map[state.Symbol]float64
+	// Status and Stats are the optimization's termination status and statistics.
+	Status optimize.Status
+	Stats  optimize.Stats
+}
+
+// Fit estimates the parameters of p. The returned error is that of optimize.Minimize.
+// Parameters for which the simulation panics have infinite loss.
+func Fit(p Problem) (*Result, error) {
+	p.verify()
+	if p.Loss == nil {
+		p.Loss = LeastSquares
+	}
+	if p.Method == nil {
+		p.Method = &optimize.NelderMead{}
+	}
+	z0 := make([]float64, len(p.Params))
+	for i, par := range p.Params {
+		z0[i] = par.unbound(par.Init)
+	}
+	weights := p.weights()
+	objective := func(z []float64) float64 {
+		r, err := p.residuals(p.bound(z))
+		if err != nil {
+			return math.Inf(1)
+		}
+		return p.Loss(r, weights)
+	}
+	problem := optimize.Problem{
+		Func: objective,
+		Grad: func(grad, z []float64) {
+			fd.Gradient(grad, objective, z, &fd.Settings{Formula: fd.Central})
+		},
+	}
+	opt, err := optimize.Minimize(problem, z0, p.Settings, p.Method)
+	if opt == nil {
+		return nil, err
+	}
+	theta := p.bound(opt.X)
+	res := &Result{
+		Params: make(map[state.Symbol]float64, len(p.Params)),
+		StdErr: make(map[state.Symbol]float64, len(p.Params)),
+		Status: opt.Status,
+		Stats:  opt.Stats,
+	}
+	for i, par := range p.Params {
+		res.Params[par.Symbol] = theta[i]
+	}
+	r, simErr := p.residuals(theta)
+	if simErr != nil {
+		return nil, simErr
+	}
+	res.Loss = p.Loss(r, weights)
+	for _, d := range p.Data {
+		res.Residuals = append(res.Residuals, r[:len(d.Time)])
+		r = r[len(d.Time):]
+	}
+	res.Covariance = p.covariance(theta, weights)
+	for i, par := range p.Params {
+		res.StdErr[par.Symbol] = math.Sqrt(res.Covariance.At(i, i))
+	}
+	return res, err
+}
+
+func (p Problem) verify() {
+	if p.Model == nil {
+		throwf("fit: Model not set")
+	}
+	if len(p.Params) == 0 {
+		throwf("fit: no parameters to estimate")
+	}
+	if len(p.Data) == 0 {
+		throwf("fit: no data")
+	}
+	for _, d := range p.Data {
+		if len(d.Time) != len(d.Values) || (d.Weights != nil && len(d.Weights) != len(d.Time)) {
+			throwf("fit: %v data Time, Values and Weights lengths mismatch", d.Symbol)
+		}
+	}
+	for _, par := range p.Params {
+		if !(par.Init > par.Min && par.Init < par.Max) {
+			throwf("fit: %v initial value %g not within bounds (%g, %g). Use infinite bounds for unbounded parameters", par.Symbol, par.Init, par.Min, par.Max)
+		}
+		// values next to a bound may round onto it
+		if z := par.unbound(par.Init); math.IsInf(z, 0) || math.IsNaN(z) {
+			throwf("fit: %v initial value %g too close to bounds (%g, %g)", par.Symbol, par.Init, par.Min, par.Max)
+		}
+	}
+}
+
+// bound returns parameter values from unbounded optimization variables z.
+func (p Problem) bound(z []float64) []float64 {
+	theta := make([]float64, len(z))
+	for i, par := range p.Params {
+		theta[i] = par.bound(z[i])
+	}
+	return theta
+}
+
+func (par Param) bound(z float64) float64 {
+	lo, hi := !math.IsInf(par.Min, -1), !math.IsInf(par.Max, 1)
+	switch {
+	case !lo && !hi:
+		return z
+	case lo && hi:
+		return par.Min + (par.Max-par.Min)/(1+math.Exp(-z))
+	case lo:
+		return par.Min + math.Exp(z)
+	default:
+		return par.Max - math.Exp(z)
+	}
+}
+
+func (par Param) unbound(theta float64) float64 {
+	lo, hi := !math.IsInf(par.Min, -1), !math.IsInf(par.Max, 1)
+	switch {
+	case !lo && !hi:
+		return theta
+	case lo && hi:
+		u := (theta - par.Min) / (par.Max - par.Min)
+		return math.Log(u / (1 - u))
+	case lo:
+		return math.Log(theta - par.Min)
+	default:
+		return math.Log(par.Max - theta)
+	}
+}
+
+func (p Problem) weights() []float64 {
+	var w []float64
+	for _, d := range p.Data {
+		for i := range d.Time {
+			if d.Weights == nil {
+				w = append(w, 1)
+			} else {
+				w = append(w, d.Weights[i])
+			}
+		}
+	}
+	return w
+}
+
+// residuals simulates the model for parameters theta and returns all residuals
+// concatenated in Data order. Simulation panics are returned as errors.
+func (p Problem) residuals(theta []float64) (r []float64, err error) {
+	defer func() {
+		if a := recover(); a != nil {
+			r, err = nil, fmt.Errorf("fit: simulation failed for parameters %v: %v", theta, a)
+		}
+	}()
+	params := make(map[state.Symbol]float64, len(p.Params))
+	for i, par := range p.Params {
+		params[par.Symbol] = theta[i]
+	}
+	sim := p.Model(params)
+	declared := sim.Params()
+	for sym, v := range params {
+		if _, ok := declared[sym]; ok {
+			declared[sym] = v
+		}
+	}
+	sim.SetParamsFromMap(declared)
+	sim.Begin()
+	for _, d := range p.Data {
+		simulated := sim.ResultsAt(d.Symbol, d.Time)
+		for i, v := range d.Values {
+			r = append(r, simulated[i]-v)
+		}
+	}
+	return r, nil
+}
+
+// covariance returns the Gauss-Newton covariance estimate at theta.
+func (p Problem) covariance(theta, weights []float64) *mat.SymDense {
+	n, m := len(weights), len(theta)
+	cov := mat.NewSymDense(m, nil)
+	nan := func() *mat.SymDense {
+		for i := 0; i < m; i++ {
+			for j := i; j < m; j++ {
+				cov.SetSym(i, j, math.NaN())
+			}
+		}
+		return cov
+	}
+	if n <= m {
+		return nan()
+	}
+	sqrtW := make([]float64, n)
+	for i, w := range weights {
+		sqrtW[i] = math.Sqrt(w)
+	}
+	var failed error
+	weighted := func(r, th []float64) {
+		res, err := p.residuals(th)
+		if err != nil {
+			failed = err
+			for i := range r {
+				r[i] = math.NaN()
+			}
+			return
+		}
+		for i := range r {
+			r[i] = sqrtW[i] * res[i]
+		}
+	}
+	r0 := make([]float64, n)
+	weighted(r0, theta)
+	J := mat.NewDense(n, m, nil)
+	fd.Jacobian(J, weighted, theta, &fd.JacobianSettings{Formula: fd.Central})
+	if failed != nil {
+		return nan()
+	}
+	s2 := 0.
+	for _, r := range r0 {
+		s2 += r * r
+	}
+	s2 /= float64(n - m)
+	var JtJ mat.SymDense
+	JtJ.SymOuterK(1, J.T())
+	var chol mat.Cholesky
+	if ok := chol.Factorize(&JtJ); !ok {
+		return nan()
+	}
+	if err := chol.InverseTo(cov); err != nil {
+		return nan()
+	}
+	cov.ScaleSym(s2, cov)
+	return cov
+}
+
+func throwf(format string, a ...interface{}) {
+	panic(fmt.Errorf(format, a...))
+}
@@ -0,0 +1,99 @@
+package fit
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim"
+	"github.com/soypat/godesim/state"
+)
+
+func decayModel(params map[state.Symbol]float64) *godesim.Simulation {
+	sim := godesim.New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return -s.P("k") * s.X("x") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": params["x0"]})
+	sim.SetParamsFromMap(map[state.Symbol]float64{"k": 1})
+	sim.SetTimespan(0, 4, 40)
+	return sim
+}
+
+func TestFitDecay(t *testing.T) {
+	const k, x0 = 0.7, 3.
+	data := Data{Symbol: "x"}
+	for i := 0; i <= 8; i++ {
+		tm := 0.5 * float64(i)
+		// deterministic measurement noise
+		noise := 0.01 * math.Sin(7*float64(i))
+		data.Time = append(data.Time, tm)
+		data.Values = append(data.Values, x0*math.Exp(-k*tm)+noise)
+	}
+	res, err := Fit(Problem{
+		Model: decayModel,
+		Data:  []Data{data},
+		Params: []Param{
+			{Symbol: "k", Init: 0.2, Min: 0, Max: 5},
+			{Symbol: "x0", Init: 1, Min: 0, Max: math.Inf(1)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(res.Params["k"]-k) > 0.02 || math.Abs(res.Params["x0"]-x0) > 0.02 {
+		t.Errorf("expected k=%g, x0=%g. got %v", k, x0, res.Params)
+	}
+	if len(res.Residuals) != 1 || len(res.Residuals[0]) != len(data.Time) {
+		t.Fatalf("unexpected residuals %v", res.Residuals)
+	}
+	for _, sym := range []state.Symbol{"k", "x0"} {
+		if se := res.StdErr[sym]; !(se > 0 && se < 0.05) {
+			t.Errorf("unexpected standard error of %s: %g", sym, se)
+		}
+	}
+	if res.Covariance.At(0, 1) != res.Covariance.At(1, 0) {
+		t.Error("covariance should be symmetric")
+	}
+}
+
+func TestParamBounds(t *testing.T) {
+	for _, par := range []Param{
+		{Min: -1, Max: 2},
+		{Min: 1, Max: math.Inf(1)},
+		{Min: math.Inf(-1), Max: -1},
+		{Min: math.Inf(-1), Max: math.Inf(1)},
+	} {
+		for _, z := range []float64{-20, -1, 0, 3} {
+			theta := par.bound(z)
+			if theta < par.Min || theta > par.Max {
+				t.Errorf("%v: bound(%g)=%g out of bounds", par, z, theta)
+			}
+			if math.Abs(z) < 5 && math.Abs(par.unbound(theta)-z) > 1e-9 {
+				t.Errorf("%v: unbound(bound(%g)) = %g", par, z, par.unbound(theta))
+			}
+		}
+	}
+}
+
+func TestFitErrors(t *testing.T) {
+	data := []Data{{Symbol: "x", Time: []float64{0, 1}, Values: []float64{1, 2}}}
+	for _, p := range []Problem{
+		{Model: decayModel, Data: data},
+		{Model: decayModel, Params: []Param{{Symbol: "k", Init: 1}}},
+		{Model: decayModel, Data: data, Params: []Param{{Symbol: "k", Init: 3, Min: 0, Max: 2}}},
+		// unbounded parameters require infinite bounds
+		{Model: decayModel, Data: data, Params: []Param{{Symbol: "k", Init: 1}}},
+		{Model: decayModel, Data: data, Params: []Param{{Symbol: "k", Init: 0, Min: 0, Max: math.Inf(1)}}},
+		{Model: decayModel, Data: data, Params: []Param{{Symbol: "k", Init: math.Nextafter(1, 0), Min: -1e17, Max: 1}}},
+		{Model: decayModel, Data: []Data{{Symbol: "x", Time: []float64{0}}}, Params: []Param{{Symbol: "k", Init: 1}}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for %+v", p)
+				}
+			}()
+			Fit(p)
+		}()
+	}
+}
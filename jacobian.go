@@ -0,0 +1,108 @@
+package godesim
+
+import (
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/diff/fd"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// defaultJacobianTolerance is used when Config.Algorithm.Jacobian.Tolerance is not set
+const defaultJacobianTolerance = 1e-4
+
+// JacobianMismatch describes a jacobian entry ∂Row/∂Col where the analytic
+// jacobian and the finite difference approximation disagree.
+type JacobianMismatch struct {
+	// Row is the X symbol whose Diff is differentiated
+	Row state.Symbol
+	// Col is the X symbol with respect to which Row's Diff is differentiated
+	Col              state.Symbol
+	Analytic         float64
+	FiniteDifference float64
+}
+
+// CheckJacobian compares the analytic jacobian set with SetJacobian
+// against a central finite difference approximation at state s.
+// Returns entries which differ by more than Config.Algorithm.Jacobian.Tolerance.
+//
+// CheckJacobian panics if no analytic jacobian was set.
+func (sim *Simulation) CheckJacobian(s state.State) []JacobianMismatch {
+	if sim.jacobian == nil {
+		throwf("CheckJacobian: no analytic jacobian set. Use SetJacobian")
+	}
+	n := s.Len()
+	analytic, approx := mat.NewDense(n, n, nil), mat.NewDense(n, n, nil)
+	sim.jacobian(analytic, s)
+	state.Jacobian(approx, sim.diffsOf(s), s, &fd.JacobianSettings{Formula: fd.Central})
+	return jacobianMismatches(analytic, approx, s.XSymbols(), sim.jacobianTolerance())
+}
+
+// jacobianAt stores the jacobian of sim.Diffs at state s in dst.
+// The analytic jacobian is used if set, else a finite difference approximation.
+func (sim *Simulation) jacobianAt(dst *mat.Dense, s state.State) {
+	if sim.sensitivity != nil {
+		sim.sensitivity.blockJacobian(sim, dst, s)
+		return
+	}
+	if sim.jacobian == nil {
+		state.Jacobian(dst, sim.Diffs, s, nil)
+		return
+	}
+	sim.jacobian(dst, s)
+	if !sim.Algorithm.Jacobian.Check {
+		return
+	}
+	n := s.Len()
+	approx := mat.NewDense(n, n, nil)
+	state.Jacobian(approx, sim.Diffs, s, &fd.JacobianSettings{Formula: fd.Central})
+	for _, m := range jacobianMismatches(dst, approx, s.XSymbols(), sim.jacobianTolerance()) {
+		sim.Logger.Logf("jacobian mismatch at %s=%g: d(%s)/d(%s) analytic %g, finite difference %g\n",
+			sim.Domain, s.Time(), m.Row, m.Col, m.Analytic, m.FiniteDifference)
+	}
+}
+
+// jacobianOf stores the jacobian of Diffs F at state s in dst, where F are
+// ordered as X symbols of s. The analytic jacobian is used if set.
+func (sim *Simulation) jacobianOf(dst *mat.Dense, F state.Diffs, s state.State) {
+	if sim.jacobian != nil {
+		sim.jacobian(dst, s)
+		return
+	}
+	state.Jacobian(dst, F, s, nil)
+}
+
+func (sim *Simulation) jacobianTolerance() float64 {
+	if sim.Algorithm.Jacobian.Tolerance > 0 {
+		return sim.Algorithm.Jacobian.Tolerance
+	}
+	return defaultJacobianTolerance
+}
+
+// diffsOf returns Diffs ordered as the X symbols of s. They are built from
+// the simulation's X functions since s may not follow the order of sim.Diffs,
+// which also count evaluations in Stats.
+func (sim *Simulation) diffsOf(s state.State) state.Diffs {
+	syms := s.XSymbols()
+	F := make(state.Diffs, len(syms))
+	for i, sym := range syms {
+		f, ok := sim.change[sym]
+		if !ok {
+			throwf("Simulation: no Diff defined for X symbol %v", sym)
+		}
+		F[i] = f
+	}
+	return F
+}
+
+func jacobianMismatches(analytic, approx *mat.Dense, syms []state.Symbol, tol float64) (mismatches []JacobianMismatch) {
+	r, c := analytic.Dims()
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			a, f := analytic.At(i, j), approx.At(i, j)
+			if !floats.EqualWithinAbsOrRel(a, f, tol, tol) {
+				mismatches = append(mismatches, JacobianMismatch{Row: syms[i], Col: syms[j], Analytic: a, FiniteDifference: f})
+			}
+		}
+	}
+	return mismatches
+}
@@ -0,0 +1,69 @@
+package godesim
+
+import (
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/mat"
+)
+
+// StateSpace is the linearization
+//  d(Δx)/dt = F0 + A*Δx + B*Δu
+// of a simulation's Diffs about an operating point, where Δx and Δu
+// are deviations from the operating point's X and U values.
+type StateSpace struct {
+	// A is ∂Diffs/∂X. Rows and columns are labelled by X.
+	A *mat.Dense
+	// B is ∂Diffs/∂U. Rows are labelled by X and columns by U. nil if there are no inputs.
+	B *mat.Dense
+	// X and U label the rows and columns of A and B.
+	X, U []state.Symbol
+	// F0 contains Diffs at the operating point, which are zero at steady states.
+	F0 []float64
+	// Point is the operating point.
+	Point state.State
+}
+
+// Linearize computes the state-space matrices of sim's Diffs at operating point op,
+// typically found with FindSteadyState. U values are those of op's Input vector and
+// are treated as independent of X. A is analytic if set with SetJacobian.
+func Linearize(sim *Simulation, op state.State) StateSpace {
+	F := sim.diffsOf(op)
+	n, m := op.Len(), len(op.USymbols())
+	ss := StateSpace{
+		A:     mat.NewDense(n, n, nil),
+		X:     op.XSymbols(),
+		U:     op.USymbols(),
+		F0:    make([]float64, n),
+		Point: op.Clone(),
+	}
+	sim.jacobianOf(ss.A, F, op)
+	if m > 0 {
+		ss.B = state.InputJacobian(mat.NewDense(n, m, nil), F, op, nil)
+	}
+	for i := range F {
+		ss.F0[i] = F[i](op)
+	}
+	return ss
+}
+
+// AAt returns ∂Diffs[row]/∂X[col].
+func (ss StateSpace) AAt(row, col state.Symbol) float64 {
+	return ss.A.At(symbolIndex(ss.X, row), symbolIndex(ss.X, col))
+}
+
+// BAt returns ∂Diffs[row]/∂U[col].
+func (ss StateSpace) BAt(row, col state.Symbol) float64 {
+	if ss.B == nil {
+		throwf("StateSpace: no inputs")
+	}
+	return ss.B.At(symbolIndex(ss.X, row), symbolIndex(ss.U, col))
+}
+
+func symbolIndex(syms []state.Symbol, sym state.Symbol) int {
+	for i, s := range syms {
+		if s == sym {
+			return i
+		}
+	}
+	throwf("StateSpace: %v symbol not found", sym)
+	return -1
+}
@@ -0,0 +1,76 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Pendulum with applied torque u
+//  θ'  = ω
+//  ω' = -g/l*sin(θ) - c*ω + u
+func TestLinearizePendulum(t *testing.T) {
+	const g, l, c = 9.8, 2., 0.1
+	sim := New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"theta": func(s state.State) float64 { return s.X("omega") },
+		"omega": func(s state.State) float64 {
+			return -g/l*math.Sin(s.X("theta")) - c*s.X("omega") + s.U("u")
+		},
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"theta": math.Pi - 0.1, "omega": 0})
+	sim.SetInputFromMap(map[state.Symbol]state.Input{"u": func(state.State) float64 { return 0 }})
+	ss := FindSteadyState(sim, nil)
+	if !ss.Converged {
+		t.Fatalf("steady state not found: %+v", ss)
+	}
+	lin := Linearize(sim, ss.State)
+	// inverted pendulum is unstable: ∂ω'/∂θ = g/l
+	want := map[[2]state.Symbol]float64{
+		{"theta", "theta"}: 0, {"theta", "omega"}: 1,
+		{"omega", "theta"}: g / l, {"omega", "omega"}: -c,
+	}
+	for k, v := range want {
+		if got := lin.AAt(k[0], k[1]); math.Abs(got-v) > 1e-6 {
+			t.Errorf("A[%s,%s]: got %g, want %g", k[0], k[1], got, v)
+		}
+	}
+	if got := lin.BAt("omega", "u"); math.Abs(got-1) > 1e-6 {
+		t.Errorf("B[omega,u]: got %g, want 1", got)
+	}
+	if got := lin.BAt("theta", "u"); got != 0 {
+		t.Errorf("B[theta,u]: got %g, want 0", got)
+	}
+	for i, f := range lin.F0 {
+		if math.Abs(f) > 1e-9 {
+			t.Errorf("expected zero Diffs at steady state, got %g for %s", f, lin.X[i])
+		}
+	}
+}
+
+// Operating points built by hand need not follow the X order of the simulation.
+func TestLinearizeUnorderedPoint(t *testing.T) {
+	sim := New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"y": func(s state.State) float64 { return 2 * s.X("x") },
+		"x": func(s state.State) float64 { return 3 * s.X("y") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 1, "y": 1})
+	sim.SetTimespan(0, 1, 4)
+	sim.Begin()
+	evals := sim.Stats().DiffEvaluations
+	op := state.New()
+	op.XEqual("y", 1)
+	op.XEqual("x", 2)
+	lin := Linearize(sim, op)
+	if got := lin.AAt("y", "x"); math.Abs(got-2) > 1e-6 {
+		t.Errorf("A[y,x]: got %g, want 2", got)
+	}
+	if got := lin.AAt("x", "y"); math.Abs(got-3) > 1e-6 {
+		t.Errorf("A[x,y]: got %g, want 3", got)
+	}
+	if sim.Stats().DiffEvaluations != evals {
+		t.Error("linearization counted in simulation Stats")
+	}
+}
@@ -45,7 +45,12 @@ func (log *Logger) Logf(format string, a ...interface{}) {
 	log.buff.WriteString(fmt.Sprintf(format, a...))
 }
 
+// flush writes buffered messages to Output. Messages are discarded if Output is nil.
 func (log *Logger) flush() {
+	if log.Output == nil {
+		log.buff.Reset()
+		return
+	}
 	log.Output.Write([]byte(log.buff.String()))
 	log.buff.Reset()
 }
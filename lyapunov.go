@@ -0,0 +1,164 @@
+package godesim
+
+import (
+	"math"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Lyapunov estimates Lyapunov exponents of a simulation's trajectory, the average
+// exponential rates at which nearby trajectories separate. A positive largest exponent
+// indicates chaos. Perturbations w are integrated with the tangent linear system
+//  dw/dt = J(x(t)) w
+// alongside the trajectory and orthonormalized with Gram-Schmidt at every result,
+// accumulating the logarithms of the perturbation growths.
+//
+// As with Adjoint, the model is integrated again between consecutive results with
+// half steps to evaluate J, subdivided until the later result is matched.
+// Results which can not be matched are reported in LyapunovResult.Drift.
+// J is analytic if set with SetJacobian.
+// Events which change Diffs are not supported.
+type Lyapunov struct {
+	// Exponents is the amount of exponents estimated, largest first.
+	// Default is 1. The full spectrum has as many exponents as X symbols.
+	Exponents int
+	// Transient is the length of domain at the start of the simulation
+	// excluded from the estimate while perturbations align with the trajectory.
+	Transient float64
+	// Steps is the least amount of fourth order Runge-Kutta steps of the tangent
+	// linear system between consecutive results. Default is 4.
+	Steps int
+}
+
+// LyapunovResult contains Lyapunov exponent estimates.
+type LyapunovResult struct {
+	// Exponents are the estimates at the end of the simulation, largest first.
+	Exponents []float64
+	// Time and History contain the running estimates at each result after the
+	// Transient, useful to assess convergence.
+	Time    []float64
+	History [][]float64
+	// Drift is the largest mismatch between a result and the integration from the previous
+	// result relative to error tolerance. Above 1 the tangent linear system does not
+	// follow the results, i.e. if these carry the error of long solver steps.
+	Drift float64
+}
+
+// Estimate runs sim and estimates it's Lyapunov exponents.
+// sim must be ready to Begin and must not have sensitivities enabled.
+func (ly Lyapunov) Estimate(sim *Simulation) LyapunovResult {
+	if sim.sensitivity != nil {
+		throwf("Lyapunov: not supported for simulations with sensitivities enabled")
+	}
+	steps := ly.Steps
+	if steps <= 0 {
+		steps = 4
+	}
+	k := ly.Exponents
+	if k <= 0 {
+		k = 1
+	}
+	sim.Begin()
+	checkpoints := sim.results
+	n := checkpoints[0].Len()
+	if k > n {
+		throwf("Lyapunov: %d exponents requested for %d X symbols", k, n)
+	}
+	t0 := checkpoints[0].Time()
+	if math.Abs(ly.Transient) >= math.Abs(checkpoints[len(checkpoints)-1].Time()-t0) {
+		throwf("Lyapunov: Transient %g not shorter than simulated domain", ly.Transient)
+	}
+	ts := &tangentSystem{sim: sim, jac: mat.NewDense(n, n, nil)}
+	// perturbations are columns of W
+	W := mat.NewDense(n, k, nil)
+	for j := 0; j < k; j++ {
+		W.Set(j, j, 1)
+	}
+	sums := make([]float64, k)
+	start, started := t0, ly.Transient == 0
+	res := LyapunovResult{}
+	for c := 1; c < len(checkpoints); c++ {
+		xs, mismatch := sim.replay(checkpoints[c-1], checkpoints[c], steps)
+		res.Drift = math.Max(res.Drift, mismatch)
+		h := (checkpoints[c].Time() - checkpoints[c-1].Time()) / float64((len(xs)-1)/2)
+		for i := 2; i < len(xs); i += 2 {
+			W = ts.step(W, xs[i-2], xs[i-1], xs[i], h)
+		}
+		growth := gramSchmidt(W)
+		t := checkpoints[c].Time()
+		if !started {
+			if math.Abs(t-t0) >= math.Abs(ly.Transient) {
+				start, started = t, true
+			}
+			continue
+		}
+		floats.Add(sums, growth)
+		estimate := make([]float64, k)
+		floats.ScaleTo(estimate, 1/math.Abs(t-start), sums)
+		res.Time = append(res.Time, t)
+		res.History = append(res.History, estimate)
+	}
+	if len(res.History) == 0 {
+		throwf("Lyapunov: no results after Transient")
+	}
+	res.Exponents = res.History[len(res.History)-1]
+	return res
+}
+
+// tangentSystem holds storage for integrating the tangent linear system.
+type tangentSystem struct {
+	sim *Simulation
+	jac *mat.Dense
+}
+
+// step integrates perturbations W a step of length h with fourth order Runge-Kutta.
+// s0 is the model state at the start of the step, sm at the middle and s1 at the end.
+func (ts *tangentSystem) step(W *mat.Dense, s0, sm, s1 state.State, h float64) *mat.Dense {
+	var k1, k2, k3, k4, tmp mat.Dense
+	k1.Mul(ts.jacobian(s0), W)
+	tmp.Scale(h/2, &k1)
+	tmp.Add(W, &tmp)
+	k2.Mul(ts.jacobian(sm), &tmp)
+	tmp.Scale(h/2, &k2)
+	tmp.Add(W, &tmp)
+	k3.Mul(ts.jac, &tmp) // jacobian at sm is unchanged
+	tmp.Scale(h, &k3)
+	tmp.Add(W, &tmp)
+	k4.Mul(ts.jacobian(s1), &tmp)
+	k1.Add(&k1, &k4)
+	k2.Add(&k2, &k3)
+	k2.Scale(2, &k2)
+	k1.Add(&k1, &k2)
+	k1.Scale(h/6, &k1)
+	k1.Add(W, &k1)
+	return &k1
+}
+
+func (ts *tangentSystem) jacobian(s state.State) *mat.Dense {
+	ts.sim.stats.JacobianEvaluations++
+	ts.sim.jacobianOf(ts.jac, ts.sim.Diffs, s)
+	return ts.jac
+}
+
+// gramSchmidt orthonormalizes the columns of W in place with modified
+// Gram-Schmidt and returns the logarithm of each column's norm before normalization.
+func gramSchmidt(W *mat.Dense) []float64 {
+	n, k := W.Dims()
+	growth := make([]float64, k)
+	col := make([]float64, n)
+	other := make([]float64, n)
+	for j := 0; j < k; j++ {
+		mat.Col(col, j, W)
+		for i := 0; i < j; i++ {
+			mat.Col(other, i, W)
+			floats.AddScaled(col, -floats.Dot(col, other), other)
+		}
+		norm := floats.Norm(col, 2)
+		growth[j] = math.Log(norm)
+		floats.Scale(1/norm, col)
+		W.SetCol(j, col)
+	}
+	return growth
+}
@@ -0,0 +1,77 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Lyapunov exponents of a linear system are the real parts of it's eigenvalues,
+// the diagonal of a triangular system. The analytic jacobian is set since
+// finite differences lose accuracy as the trajectory grows unbounded.
+func TestLyapunovLinear(t *testing.T) {
+	A := mat.NewDense(3, 3, []float64{
+		1, 5, 0,
+		0, -1, 1,
+		0, 0, -3,
+	})
+	model := func() *Simulation {
+		sim := New()
+		sim.Solver = RK4Solver
+		sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+			"x": func(s state.State) float64 { return s.X("x") + 5*s.X("y") },
+			"y": func(s state.State) float64 { return -s.X("y") + s.X("z") },
+			"z": func(s state.State) float64 { return -3 * s.X("z") },
+		})
+		sim.SetX0FromMap(map[state.Symbol]float64{"x": 1, "y": 1, "z": 1})
+		sim.SetTimespan(0, 20, 400)
+		sim.SetJacobian(func(dst *mat.Dense, _ state.State) { dst.Copy(A) })
+		return sim
+	}
+	res := Lyapunov{Exponents: 3, Transient: 2}.Estimate(model())
+	expected := []float64{1, -1, -3}
+	for i, e := range expected {
+		if math.Abs(res.Exponents[i]-e) > 1e-6 {
+			t.Errorf("exponent %d: expected %g, got %g", i, e, res.Exponents[i])
+		}
+	}
+	if len(res.Time) != len(res.History) || res.Time[0] <= 2 {
+		t.Errorf("history must follow transient. got times %v", res.Time[:2])
+	}
+	largest := Lyapunov{}.Estimate(model())
+	if len(largest.Exponents) != 1 || math.Abs(largest.Exponents[0]-1) > 1e-6 {
+		t.Errorf("expected largest exponent 1, got %v", largest.Exponents)
+	}
+}
+
+// The Lorenz system is chaotic with largest exponent ≈ 0.906 and the
+// sum of exponents is the divergence of the flow -(σ + 1 + β).
+func TestLyapunovLorenz(t *testing.T) {
+	const sigma, rho, beta = 10., 28., 8. / 3.
+	sim := New()
+	sim.Solver = RK4Solver
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return sigma * (s.X("y") - s.X("x")) },
+		"y": func(s state.State) float64 { return s.X("x")*(rho-s.X("z")) - s.X("y") },
+		"z": func(s state.State) float64 { return s.X("x")*s.X("y") - beta*s.X("z") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 1, "y": 1, "z": 1})
+	sim.SetTimespan(0, 200, 20000)
+	// results of steps this long match their integration with half steps to about 1e-4
+	sim.Algorithm.Error.AbsTol = 1e-4
+	res := Lyapunov{Exponents: 3, Transient: 10, Steps: 1}.Estimate(sim)
+	if res.Drift > 1 {
+		t.Errorf("expected results to be matched within tolerance, got drift %g", res.Drift)
+	}
+	if math.Abs(res.Exponents[0]-0.906) > 0.1 {
+		t.Errorf("expected largest exponent ≈ 0.906, got %g", res.Exponents[0])
+	}
+	if math.Abs(res.Exponents[1]) > 0.05 {
+		t.Errorf("expected zero exponent along the flow, got %g", res.Exponents[1])
+	}
+	if sum := res.Exponents[0] + res.Exponents[1] + res.Exponents[2]; math.Abs(sum+sigma+1+beta) > 0.05 {
+		t.Errorf("expected exponents to sum %g, got %g", -(sigma + 1 + beta), sum)
+	}
+}
@@ -0,0 +1,314 @@
+package godesim
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/exp/linsolve"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Default values for Config.Algorithm.Newton
+const (
+	defaultNewtonContraction = 0.5
+	defaultNewtonStepChange  = 0.2
+	defaultNewtonDirectMax   = 200
+	// used when Config.Algorithm.Newton.Tolerance and IterationMax are not set
+	defaultNewtonTolerance    = 1e-5
+	defaultNewtonIterationMax = 10
+	// newtonMaxHalvings is the amount of times a failed step length is halved
+	// when no Config.Algorithm.Step.Min is set.
+	newtonMaxHalvings = 10
+)
+
+// newtonStatus is the outcome of the Newton iterations of a step
+type newtonStatus int
+
+const (
+	newtonConverged newtonStatus = iota
+	// did not reach Config.Algorithm.Newton.Tolerance in Config.Algorithm.IterationMax iterations
+	// or GMRES did not solve the linear system
+	newtonNotConverged
+	// residual or iterate contains NaN or Inf values
+	newtonDiverged
+)
+
+func (st newtonStatus) String() string {
+	switch st {
+	case newtonConverged:
+		return "convergence"
+	case newtonNotConverged:
+		return "convergence failure"
+	case newtonDiverged:
+		return "divergence"
+	}
+	return "unknown newton status"
+}
+
+// newtonIterate solves residual functions F(X) = 0 for a step of length h
+// starting from guess. Returns the last iterate.
+func newtonIterate(sim *Simulation, F state.Diffs, guess state.State, h float64) (state.State, newtonStatus) {
+	n := len(F)
+	jacMult := 1 - sim.Algorithm.RelaxationFactor
+	modified := sim.Algorithm.Newton.Modified
+	contraction, stepChange := sim.Algorithm.Newton.Contraction, sim.Algorithm.Newton.StepChange
+	if contraction <= 0 {
+		contraction = defaultNewtonContraction
+	}
+	if stepChange <= 0 {
+		stepChange = defaultNewtonStepChange
+	}
+	errMax, iterMax := sim.newtonLimits()
+	ns := sim.newton
+	ns.fresh = false
+	dx := mat.NewVecDense(n, nil)
+	auxState := guess.Clone()
+	// iteration loop counter
+	iter := 0
+	ierr, prevErr := 0.0, math.Inf(1)
+	// |X_(g) - X_(i)| < permissible error
+	for iter == 0 || (iter < iterMax && ierr > errMax) {
+		// We solve  J^-1 * b  where b = F(X_(g)) and J = J(X_(g))
+		residual := StateDiff(F, guess).XVector()
+		if !isFinite(residual) {
+			return guess, newtonDiverged
+		}
+		b := mat.NewVecDense(n, residual)
+		// Jacobian of residual functions is I - step * J(X_(g)). Modified
+		// Newton reuses the last factorization while it converges well.
+		if !modified || ns.stale(h, stepChange) {
+			ns.update(sim, guess, h)
+		}
+		if err := ns.solve(sim, dx, b); err != nil {
+			if _, ok := err.(mat.Condition); !ok {
+				// iterative solve did not converge, retried with a smaller step
+				return guess, newtonNotConverged
+			}
+		}
+		auxState.SetAllX(dx.RawVector().Data)
+
+		// X_(i+1) = X_(i) - alpha * F(X_(g)) / J(X_(g)) where g are guesses, and alpha is the relaxation factor
+		state.AddScaledTo(auxState, guess, -jacMult, auxState)
+		// error calculation
+		errvec := guess.XVector()
+		floats.Sub(errvec, auxState.XVector())
+		for i := range errvec {
+			errvec[i] = math.Abs(errvec[i])
+		}
+		ierr = floats.Max(errvec)
+		guess.SetAllX(auxState.XVector())
+		if math.IsNaN(ierr) || math.IsInf(ierr, 0) {
+			return guess, newtonDiverged
+		}
+		if modified && iter > 0 && ierr > contraction*prevErr {
+			ns.valid = false // convergence is slow, refactorize
+		}
+		prevErr = ierr
+		iter++
+		sim.stats.NewtonIterations++
+	}
+	if ierr > errMax {
+		return guess, newtonNotConverged
+	}
+	return guess, newtonConverged
+}
+
+// newtonLimits returns the Newton convergence threshold and maximum
+// amount of iterations, falling back to defaults if not configured.
+func (sim *Simulation) newtonLimits() (errMax float64, iterMax int) {
+	errMax, iterMax = sim.Algorithm.Newton.Tolerance, sim.Algorithm.IterationMax
+	if errMax <= 0 {
+		errMax = defaultNewtonTolerance
+	}
+	if iterMax <= 0 {
+		iterMax = defaultNewtonIterationMax
+	}
+	return errMax, iterMax
+}
+
+// newtonFailure records a failed Newton step starting at state s with step length h.
+func (sim *Simulation) newtonFailure(status newtonStatus, s state.State, h float64) {
+	switch status {
+	case newtonNotConverged:
+		sim.stats.NewtonFailures++
+	case newtonDiverged:
+		sim.stats.NewtonDivergences++
+	}
+	if sim.Algorithm.Newton.FailureEvents {
+		sim.events = append(sim.events, struct {
+			Label string
+			State state.State
+		}{Label: fmt.Sprintf("newton %s with step %g", status, h), State: s.Clone()})
+	}
+}
+
+func isFinite(v []float64) bool {
+	for _, f := range v {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// newtonSystem solves the linear system of a Newton iteration
+//  (I - h*J) * dx = b
+// where J is the jacobian of Diffs at a guess and h is the step length.
+// Systems of up to Config.Algorithm.Newton.DirectMax variables are solved
+// with a dense LU factorization, larger systems with GMRES. If the jacobian's
+// sparsity pattern is known the matrix is stored in compressed sparse row format
+// and GMRES is preconditioned with an incomplete LU factorization, else with
+// the matrix diagonal.
+//
+// The factorization (or matrix for GMRES) is kept so that it may be
+// reused by modified Newton iterations.
+type newtonSystem struct {
+	n     int
+	h     float64
+	valid bool
+	// fresh is set when system is updated during the current step
+	fresh bool
+	// direct solve storage
+	direct bool
+	dense  *mat.Dense
+	lu     mat.LU
+	// iterative solve storage
+	sparse, residual *sparseMatrix
+	iterative        linsolve.MulVecToer
+	precon           func(dst *mat.VecDense, trans bool, rhs mat.Vector) error
+}
+
+func newNewtonSystem(sim *Simulation, n int) *newtonSystem {
+	ns := &newtonSystem{n: n}
+	directMax := sim.Algorithm.Newton.DirectMax
+	if directMax <= 0 {
+		directMax = defaultNewtonDirectMax
+	}
+	ns.direct = n <= directMax
+	// analytic and sensitivity jacobians are evaluated into a dense matrix
+	if ns.direct || sim.sparsity == nil || sim.jacobian != nil || sim.sensitivity != nil {
+		ns.dense = mat.NewDense(n, n, nil)
+	}
+	if sim.sparsity != nil {
+		ns.sparse = sim.sparsity.newSparseMatrix(false)
+		ns.residual = sim.sparsity.newSparseMatrix(true)
+	}
+	return ns
+}
+
+// update evaluates the jacobian at s and factorizes I - h*J.
+func (ns *newtonSystem) update(sim *Simulation, s state.State, h float64) {
+	ns.h = h
+	ns.valid = true
+	ns.fresh = true
+	sim.stats.JacobianEvaluations++
+	start := time.Now()
+	if ns.sparse != nil {
+		if sim.jacobian != nil || sim.sensitivity != nil {
+			sim.jacobianAt(ns.dense, s)
+			ns.sparse.gather(ns.dense)
+		} else {
+			sim.sparsity.jacobian(ns.sparse, sim.Diffs, s)
+		}
+		sim.stats.Time.Jacobian += time.Since(start)
+		start = time.Now()
+		defer func() { sim.stats.Time.LinearSolve += time.Since(start) }()
+		ns.residual.residualJacobian(h, ns.sparse)
+		if !ns.direct {
+			ns.iterative, ns.precon = ns.residual, nil
+			if lu, ok := newILU(ns.residual); ok {
+				ns.precon = lu.solve
+			}
+			return
+		}
+		ns.dense.Zero()
+		for i := 0; i < ns.n; i++ {
+			for k := ns.residual.rowptr[i]; k < ns.residual.rowptr[i+1]; k++ {
+				ns.dense.Set(i, ns.residual.colidx[k], ns.residual.data[k])
+			}
+		}
+	} else {
+		sim.jacobianAt(ns.dense, s)
+		sim.stats.Time.Jacobian += time.Since(start)
+		start = time.Now()
+		defer func() { sim.stats.Time.LinearSolve += time.Since(start) }()
+		ns.dense.Scale(-h, ns.dense)
+		for k := 0; k < ns.n; k++ {
+			ns.dense.Set(k, k, 1+ns.dense.At(k, k))
+		}
+	}
+	if ns.direct {
+		ns.lu.Factorize(ns.dense)
+		return
+	}
+	ns.iterative, ns.precon = denseOperator{ns.dense}, jacobiPreconditioner(ns.dense)
+}
+
+// solve stores the solution of the factorized system for right hand side b in dst.
+func (ns *newtonSystem) solve(sim *Simulation, dst, b *mat.VecDense) error {
+	sim.stats.LinearSolves++
+	start := time.Now()
+	defer func() { sim.stats.Time.LinearSolve += time.Since(start) }()
+	if ns.direct {
+		return ns.lu.SolveVecTo(dst, false, b)
+	}
+	_, err := linsolve.Iterative(ns.iterative, b, &linsolve.GMRES{}, &linsolve.Settings{Dst: dst, PreconSolve: ns.precon})
+	return err
+}
+
+// stale returns true if system must be updated before solving for step length h.
+func (ns *newtonSystem) stale(h, maxChange float64) bool {
+	return !ns.valid || math.Abs(h-ns.h) > maxChange*math.Abs(ns.h)
+}
+
+// denseOperator implements gonum/exp/linsolve's MulVecToer for a dense matrix.
+type denseOperator struct {
+	*mat.Dense
+}
+
+func (d denseOperator) MulVecTo(dst *mat.VecDense, trans bool, x mat.Vector) {
+	if trans {
+		dst.MulVec(d.Dense.T(), x)
+		return
+	}
+	dst.MulVec(d.Dense, x)
+}
+
+// jacobiPreconditioner returns a preconditioner which divides by the diagonal of a.
+// Zero diagonal entries are left as is.
+func jacobiPreconditioner(a *mat.Dense) func(dst *mat.VecDense, trans bool, rhs mat.Vector) error {
+	n, _ := a.Dims()
+	inv := make([]float64, n)
+	for i := range inv {
+		inv[i] = 1
+		if d := a.At(i, i); d != 0 {
+			inv[i] = 1 / d
+		}
+	}
+	return func(dst *mat.VecDense, _ bool, rhs mat.Vector) error {
+		for i, v := range inv {
+			dst.SetVec(i, v*rhs.AtVec(i))
+		}
+		return nil
+	}
+}
+
+// solveDense returns the solution x of A*x = b. ok is false for singular systems
+// and those whose condition number exceeds mat.ConditionTolerance, for which
+// the solution has no accurate digits.
+func solveDense(A *mat.Dense, b []float64) (x []float64, ok bool) {
+	var lu mat.LU
+	lu.Factorize(A)
+	if !(lu.Cond() < mat.ConditionTolerance) {
+		return nil, false
+	}
+	v := mat.NewVecDense(len(b), nil)
+	if err := lu.SolveVecTo(v, false, mat.NewVecDense(len(b), append([]float64{}, b...))); err != nil {
+		return nil, false
+	}
+	x = v.RawVector().Data
+	return x, !floats.HasNaN(x) && !math.IsInf(floats.Norm(x, 2), 0)
+}
@@ -0,0 +1,131 @@
+package godesim
+
+import (
+	"math"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Section is a Poincaré section of a simulation's trajectory: the surface on which
+// Guard is zero. Crossings are detected by a change of sign of Guard between
+// consecutive results, so unlike Eventers, which are checked once per Timespan step,
+// every solver step is inspected. i.e. the section θ₁ = 0 crossed with positive velocity:
+//  sec := Section{Guard: func(s state.State) float64 { return s.X("theta1") }, Direction: 1}
+type Section struct {
+	// Guard is zero on the section. See Hyperplane.
+	Guard func(s state.State) float64
+	// Direction selects crossings where Guard increases (positive), decreases (negative)
+	// or both (zero).
+	Direction int
+	// Refine locates crossings by integrating the model from the preceding result
+	// with a fourth order Runge-Kutta step whose length is found with the Illinois method.
+	// Otherwise crossings are linearly interpolated between results. Refinement uses
+	// Diffs at the end of the simulation so simulations whose events changed Diffs
+	// with DiffChangeFromMap are rejected. Other Diff changes are not detected.
+	Refine bool
+}
+
+// Hyperplane returns a guard which is zero on the hyperplane Σ normal[sym]*X(sym) = offset.
+func Hyperplane(normal map[state.Symbol]float64, offset float64) func(state.State) float64 {
+	return func(s state.State) float64 {
+		sum := -offset
+		for sym, n := range normal {
+			sum += n * s.X(sym)
+		}
+		return sum
+	}
+}
+
+// Crossings returns the states at which the trajectory of sim crosses the section
+// in order. sim must have been run beforehand.
+func (sec Section) Crossings(sim *Simulation) []state.State {
+	if sec.Guard == nil {
+		throwf("Section: Guard not set")
+	}
+	if len(sim.results) == 0 {
+		throwf("Section: no results. Did you remember to call Begin() ?")
+	}
+	if sec.Refine && sim.diffsChanged {
+		throwf("Section: Refine not supported for simulations whose events changed Diffs")
+	}
+	var crossings []state.State
+	g0 := sec.Guard(sim.results[0])
+	for i := 1; i < len(sim.results); i++ {
+		s0, s1 := sim.results[i-1], sim.results[i]
+		g1 := sec.Guard(s1)
+		// a result on the section counts as a crossing of the interval ending on it
+		crossed := (g0 < 0 && g1 >= 0) || (g0 > 0 && g1 <= 0)
+		if crossed && (sec.Direction == 0 || float64(sec.Direction)*(g1-g0) > 0) {
+			crossings = append(crossings, sec.locate(sim, s0, s1, g0, g1))
+		}
+		g0 = g1
+	}
+	return crossings
+}
+
+// locate returns the state on the section between s0 and s1.
+func (sec Section) locate(sim *Simulation, s0, s1 state.State, g0, g1 float64) state.State {
+	linear := func() state.State {
+		a := g0 / (g0 - g1)
+		s := s0.Clone()
+		state.AddScaled(s, a, state.SubTo(s0.CloneBlank(0), s1, s0))
+		s.SetTime(s0.Time() + a*(s1.Time()-s0.Time()))
+		return s
+	}
+	if g1 == 0 {
+		return s1.Clone()
+	}
+	if !sec.Refine {
+		return linear()
+	}
+	H := s1.Time() - s0.Time()
+	// guard after integrating a step of length h from s0
+	guard := func(h float64) (float64, state.State) {
+		s := rk4Step(sim.Diffs, s0, h)
+		return sec.Guard(s), s
+	}
+	lo, hi, glo := 0., H, g0
+	ghi, _ := guard(H)
+	if glo*ghi > 0 {
+		// integration does not bracket the section
+		return linear()
+	}
+	tol := 1e-12 * math.Max(math.Abs(g0), math.Abs(g1))
+	side := 0
+	s := s0
+	for k := 0; k < 50; k++ {
+		h := (lo*ghi - hi*glo) / (ghi - glo)
+		var g float64
+		g, s = guard(h)
+		if math.Abs(g) <= tol || math.Abs(hi-lo) <= 1e-14*math.Abs(H) {
+			break
+		}
+		if g*ghi > 0 {
+			hi, ghi = h, g
+			if side == -1 {
+				glo /= 2
+			}
+			side = -1
+		} else {
+			lo, glo = h, g
+			if side == 1 {
+				ghi /= 2
+			}
+			side = 1
+		}
+	}
+	return s
+}
+
+// ReturnMap returns consecutive values of sym at crossings so that
+// next[i] is the value at the crossing following x[i].
+func ReturnMap(crossings []state.State, sym state.Symbol) (x, next []float64) {
+	if len(crossings) < 2 {
+		return nil, nil
+	}
+	x, next = make([]float64, len(crossings)-1), make([]float64, len(crossings)-1)
+	for i := range x {
+		x[i], next[i] = crossings[i].X(sym), crossings[i+1].X(sym)
+	}
+	return x, next
+}
@@ -0,0 +1,84 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Harmonic oscillator x = cos(t), v = -sin(t) crosses the section
+//  x + v = √2 cos(t + π/4) = 0.5
+// in the rising direction once per period.
+func TestSectionCrossings(t *testing.T) {
+	sim := New()
+	sim.Solver = RK4Solver
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return s.X("v") },
+		"v": func(s state.State) float64 { return -s.X("x") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 1, "v": 0})
+	sim.SetTimespan(0, 20, 400)
+	sim.Begin()
+	first := 2*math.Pi - math.Acos(0.5/math.Sqrt2) - math.Pi/4
+	for _, test := range []struct {
+		refine bool
+		tol    float64
+	}{{false, 2e-4}, {true, 2e-6}} {
+		sec := Section{Guard: Hyperplane(map[state.Symbol]float64{"x": 1, "v": 1}, 0.5), Direction: 1, Refine: test.refine}
+		crossings := sec.Crossings(sim)
+		if len(crossings) != 3 {
+			t.Fatalf("refine=%v: expected 3 crossings, got %d", test.refine, len(crossings))
+		}
+		for i, c := range crossings {
+			expected := first + 2*math.Pi*float64(i)
+			if math.Abs(c.Time()-expected) > test.tol {
+				t.Errorf("refine=%v: crossing %d expected at t=%g, got %g", test.refine, i, expected, c.Time())
+			}
+			if math.Abs(c.X("x")+c.X("v")-0.5) > test.tol {
+				t.Errorf("refine=%v: crossing %d not on section: %v", test.refine, i, c.XVector())
+			}
+		}
+		// periodic orbit is a fixed point of the return map
+		x, next := ReturnMap(crossings, "x")
+		for i := range x {
+			if math.Abs(x[i]-next[i]) > test.tol {
+				t.Errorf("refine=%v: expected fixed point of return map, got %g -> %g", test.refine, x[i], next[i])
+			}
+		}
+	}
+	if n := len(Section{Guard: Hyperplane(map[state.Symbol]float64{"x": 1}, 0)}.Crossings(sim)); n != 6 {
+		t.Errorf("expected 6 crossings of x=0 in both directions, got %d", n)
+	}
+}
+
+// Refinement integrates with the final Diffs, which differ from
+// those of results before a DiffChangeFromMap event.
+func TestSectionRefineDiffChange(t *testing.T) {
+	sim := New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return 1 },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": -1})
+	sim.SetTimespan(0, 2, 20)
+	sim.AddEventHandlers(TypicalEventer{label: "reverse", action: func(s state.State) func(*Simulation) error {
+		if s.Time() >= 1.5 {
+			return DiffChangeFromMap(map[state.Symbol]func(state.State) float64{
+				"x": func(s state.State) float64 { return -1 },
+			})
+		}
+		return nil
+	}})
+	sim.Begin()
+	sec := Section{Guard: Hyperplane(map[state.Symbol]float64{"x": 1}, 0), Direction: 1}
+	if n := len(sec.Crossings(sim)); n != 1 {
+		t.Errorf("expected 1 crossing, got %d", n)
+	}
+	sec.Refine = true
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic refining crossings after Diffs changed")
+		}
+	}()
+	sec.Crossings(sim)
+}
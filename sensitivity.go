@@ -0,0 +1,294 @@
+package godesim
+
+import (
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/diff/fd"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// SetSensitivity enables forward sensitivity analysis of X variables with
+// respect to params, which must be set with SetParamsFromMap, and with respect
+// to the initial values of x0 X symbols. The sensitivities
+//  S = ∂x/∂θ
+// are integrated alongside X by the simulation's solver as additional X variables
+// named "∂x/∂p" for a parameter p and "∂x/∂y(0)" for the initial value of y:
+//  dS/dt = J*S + ∂Diffs/∂θ
+// where J is the jacobian of Diffs, which is analytic if set with SetJacobian.
+// ∂Diffs/∂p is approximated with finite differences unless set with SetParamJacobian.
+// Sensitivities are subject to adaptive solver error control as X variables are,
+// so tolerances may be set for them in Config.Algorithm.Error.Symbols.
+//
+// Implicit solvers approximate the jacobian of the augmented system with
+// J repeated along the diagonal. A sparsity pattern set with SetJacobianSparsity
+// is repeated likewise while Config.Algorithm.Jacobian.DetectSparsity is ignored.
+//
+// Results are obtained with Sensitivity and SensitivityX0.
+func (sim *Simulation) SetSensitivity(params, x0 []state.Symbol) {
+	if len(params) == 0 && len(x0) == 0 {
+		throwf("SetSensitivity: no parameters or initial values given")
+	}
+	sim.sensitivity = &sensitivity{
+		params: append([]state.Symbol{}, params...),
+		x0:     append([]state.Symbol{}, x0...),
+	}
+}
+
+// SetParamJacobian sets an analytic jacobian of the Diffs system with respect to
+// the parameters given to SetSensitivity or Adjoint. f must store ∂Diffs[i]/∂P[j] in dst.At(i, j)
+// for the n×m dst matrix. Rows follow the order of model X symbols (see SetJacobian)
+// and columns the order of SetSensitivity or Adjoint parameters.
+func (sim *Simulation) SetParamJacobian(f func(dst *mat.Dense, s state.State)) {
+	sim.paramJacobian = f
+}
+
+// Sensitivity returns the sensitivity ∂x/∂p of X variable x with
+// respect to parameter p at each result point. See SetSensitivity.
+func (sim *Simulation) Sensitivity(x, p state.Symbol) []float64 {
+	return sim.sensitivityResults(x, p, sensitivitySymbol(x, p))
+}
+
+// SensitivityX0 returns the sensitivity ∂x/∂y(0) of X variable x with respect
+// to the initial value of X variable y at each result point. See SetSensitivity.
+func (sim *Simulation) SensitivityX0(x, y state.Symbol) []float64 {
+	return sim.sensitivityResults(x, y, sensitivitySymbol(x, y+"(0)"))
+}
+
+func (sim *Simulation) sensitivityResults(x, wrt, sym state.Symbol) []float64 {
+	if sim.sensitivity == nil {
+		throwf("Simulation: sensitivities not enabled. Use SetSensitivity")
+	}
+	if floats.HasNaN(sim.State.ConsistencyX([]state.Symbol{sym})) {
+		throwf("Simulation: sensitivity of %v with respect to %v not found", x, wrt)
+	}
+	return sim.Results(sym)
+}
+
+func sensitivitySymbol(x, wrt state.Symbol) state.Symbol {
+	return "∂" + x + "/∂" + wrt
+}
+
+// sensitivity holds the forward sensitivity equations' structure
+// and the derivative of the last evaluated state.
+type sensitivity struct {
+	params, x0 []state.Symbol
+	// model is the set of X symbols which are not sensitivities
+	model map[state.Symbol]bool
+	// rows contains the row of model X symbols in jac and deriv
+	rows map[state.Symbol]int
+	// idx contains the positions of model X symbols in State X
+	idx []int
+	// sidx[i][j] is the position of ∂x_i/∂θ_j in State X. Parameters precede initial values.
+	sidx [][]int
+	// cache key
+	valid   bool
+	t       float64
+	x, u, p []float64
+	// jac is J and deriv is dS/dt at cached state
+	jac, deriv *mat.Dense
+}
+
+// augment adds sensitivity X variables and their Diffs to sim. Called before State is ordered.
+func (sens *sensitivity) augment(sim *Simulation) {
+	xsyms := sim.State.XSymbols()
+	sens.model = make(map[state.Symbol]bool, len(xsyms))
+	for _, sym := range xsyms {
+		sens.model[sym] = true
+	}
+	for _, p := range sens.params {
+		if _, ok := sim.params[p]; !ok {
+			throwf("SetSensitivity: parameter %v not set. Use SetParamsFromMap", p)
+		}
+	}
+	for _, y := range sens.x0 {
+		if !sens.model[y] {
+			throwf("SetSensitivity: %v not found in X symbols", y)
+		}
+	}
+	change := make(map[state.Symbol]state.Diff, len(sim.change)*(1+len(sens.params)+len(sens.x0)))
+	for sym, f := range sim.change {
+		change[sym] = f
+	}
+	for _, x := range xsyms {
+		for j, wrt := range sens.wrt() {
+			sym := sensitivitySymbol(x, wrt)
+			s0 := 0.
+			if j >= len(sens.params) && sens.x0[j-len(sens.params)] == x {
+				s0 = 1
+			}
+			sim.State.XEqual(sym, s0)
+			change[sym] = sens.diff(sim, x, j)
+		}
+	}
+	sim.change = change
+}
+
+// diff returns the Diff of ∂x/∂θ_j.
+func (sens *sensitivity) diff(sim *Simulation, x state.Symbol, j int) state.Diff {
+	return func(s state.State) float64 {
+		return sens.derivative(sim, s).At(sens.rows[x], j)
+	}
+}
+
+// wrt returns the symbols of parameters followed by initial values as named in sensitivity symbols.
+func (sens *sensitivity) wrt() []state.Symbol {
+	wrt := append([]state.Symbol{}, sens.params...)
+	for _, y := range sens.x0 {
+		wrt = append(wrt, y+"(0)")
+	}
+	return wrt
+}
+
+// index sets positions of model and sensitivity variables in State X.
+// Called once State is ordered.
+func (sens *sensitivity) index(s state.State) {
+	pos := make(map[state.Symbol]int, s.Len())
+	for i, sym := range s.XSymbols() {
+		pos[sym] = i
+	}
+	sens.idx, sens.sidx = sens.idx[:0], sens.sidx[:0]
+	sens.rows = make(map[state.Symbol]int, len(sens.model))
+	wrt := sens.wrt()
+	for _, sym := range s.XSymbols() {
+		if !sens.model[sym] {
+			continue
+		}
+		sens.rows[sym] = len(sens.idx)
+		sens.idx = append(sens.idx, pos[sym])
+		row := make([]int, len(wrt))
+		for j, w := range wrt {
+			row[j] = pos[sensitivitySymbol(sym, w)]
+		}
+		sens.sidx = append(sens.sidx, row)
+	}
+	n := len(sens.idx)
+	sens.jac, sens.deriv = mat.NewDense(n, n, nil), mat.NewDense(n, len(wrt), nil)
+	sens.valid = false
+}
+
+// modelSymbols returns the model X symbols of s in the order of jacobian rows.
+func (sens *sensitivity) modelSymbols(s state.State) []state.Symbol {
+	syms := s.XSymbols()
+	model := make([]state.Symbol, len(sens.idx))
+	for i, k := range sens.idx {
+		model[i] = syms[k]
+	}
+	return model
+}
+
+// sparsity returns the structure of the n×n augmented jacobian approximated by
+// blockJacobian. rows contains the nonzero columns of each model jacobian row.
+func (sens *sensitivity) sparsity(n int, rows [][]int) *sparsity {
+	aug := make([][]int, n)
+	for i, cols := range rows {
+		for _, k := range cols {
+			aug[sens.idx[i]] = append(aug[sens.idx[i]], sens.idx[k])
+			for j, row := range sens.sidx[i] {
+				aug[row] = append(aug[row], sens.sidx[k][j])
+			}
+		}
+	}
+	return newSparsity(n, aug)
+}
+
+// modelDiffs returns the Diffs of model X variables.
+func (sens *sensitivity) modelDiffs(sim *Simulation) state.Diffs {
+	F := make(state.Diffs, len(sens.idx))
+	for i, k := range sens.idx {
+		F[i] = sim.Diffs[k]
+	}
+	return F
+}
+
+// modelState returns s without sensitivity variables so that
+// it may be passed to SetJacobian and SetParamJacobian functions.
+func (sens *sensitivity) modelState(s state.State) state.State {
+	m := state.New()
+	m.SetTime(s.Time())
+	syms := s.XSymbols()
+	for _, k := range sens.idx {
+		m.XEqual(syms[k], s.X(syms[k]))
+	}
+	for _, sym := range s.USymbols() {
+		m.UEqual(sym, s.U(sym))
+	}
+	for _, sym := range s.PSymbols() {
+		m.PEqual(sym, s.P(sym))
+	}
+	return m
+}
+
+// derivative returns dS/dt at s. The result is cached since
+// all sensitivity Diffs are evaluated at the same states.
+func (sens *sensitivity) derivative(sim *Simulation, s state.State) *mat.Dense {
+	x, u, p := s.XVector(), s.UVector(), s.PVector()
+	if sens.valid && sens.t == s.Time() && floats.Equal(sens.x, x) && floats.Equal(sens.u, u) && floats.Equal(sens.p, p) {
+		return sens.deriv
+	}
+	m := sens.modelState(s)
+	F := sens.modelDiffs(sim)
+	sens.jacobian(sim, m, F)
+	np := len(sens.params)
+	sens.deriv.Zero()
+	if np > 0 {
+		sim.paramJacobianAt(sens.deriv.Slice(0, len(sens.idx), 0, np).(*mat.Dense), m, F, sens.params)
+	}
+	S := mat.NewDense(len(sens.idx), len(sens.sidx[0]), nil)
+	for i, row := range sens.sidx {
+		for j, k := range row {
+			S.Set(i, j, x[k])
+		}
+	}
+	var JS mat.Dense
+	JS.Mul(sens.jac, S)
+	sens.deriv.Add(sens.deriv, &JS)
+	sens.valid, sens.t, sens.x, sens.u, sens.p = true, s.Time(), x, u, p
+	return sens.deriv
+}
+
+// jacobian stores the jacobian of model Diffs F at model state m.
+func (sens *sensitivity) jacobian(sim *Simulation, m state.State, F state.Diffs) {
+	sim.stats.JacobianEvaluations++
+	sim.jacobianOf(sens.jac, F, m)
+}
+
+// blockJacobian stores the approximate jacobian of the augmented system at s in dst,
+// which is the model jacobian for model variables and each parameter's sensitivities.
+func (sens *sensitivity) blockJacobian(sim *Simulation, dst *mat.Dense, s state.State) {
+	sens.jacobian(sim, sens.modelState(s), sens.modelDiffs(sim))
+	dst.Zero()
+	for i := range sens.idx {
+		for k := range sens.idx {
+			v := sens.jac.At(i, k)
+			if v == 0 {
+				continue
+			}
+			dst.Set(sens.idx[i], sens.idx[k], v)
+			for j := range sens.sidx[i] {
+				dst.Set(sens.sidx[i][j], sens.sidx[k][j], v)
+			}
+		}
+	}
+}
+
+// paramJacobianAt stores the jacobian of Diffs F with respect to params at state s in dst.
+// The analytic jacobian is used if set with SetParamJacobian, else a finite difference approximation.
+func (sim *Simulation) paramJacobianAt(dst *mat.Dense, s state.State, F state.Diffs, params []state.Symbol) {
+	if sim.paramJacobian != nil {
+		sim.paramJacobian(dst, s)
+		return
+	}
+	p0 := make([]float64, len(params))
+	for j, sym := range params {
+		p0[j] = s.P(sym)
+	}
+	fd.Jacobian(dst, func(y, pv []float64) {
+		sp := s.Clone()
+		for j, sym := range params {
+			sp.PSet(sym, pv[j])
+		}
+		for i := range F {
+			y[i] = F[i](sp)
+		}
+	}, p0, nil)
+}
@@ -0,0 +1,142 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Exponential decay x(t) = x0*exp(-k*t) has sensitivities
+//  ∂x/∂k    = -t*x0*exp(-k*t)
+//  ∂x/∂x(0) = exp(-k*t)
+func TestSensitivityDecay(t *testing.T) {
+	const k, x0 = 0.5, 2.
+	for _, solver := range []struct {
+		name string
+		f    func(*Simulation) []state.State
+		tol  float64
+	}{
+		{"rk4", RK4Solver, 1e-6},
+		{"rkf45", RKF45Solver, 1e-5},
+		// first order error of newton is of order dt
+		{"newton", NewtonRaphsonSolver, 5e-2},
+	} {
+		for _, analytic := range []bool{false, true} {
+			sim := New()
+			sim.Solver = solver.f
+			sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+				"x": func(s state.State) float64 { return -s.P("k") * s.X("x") },
+			})
+			sim.SetX0FromMap(map[state.Symbol]float64{"x": x0})
+			sim.SetParamsFromMap(map[state.Symbol]float64{"k": k})
+			sim.SetSensitivity([]state.Symbol{"k"}, []state.Symbol{"x"})
+			if analytic {
+				sim.SetJacobian(func(dst *mat.Dense, s state.State) { dst.Set(0, 0, -s.P("k")) })
+				sim.SetParamJacobian(func(dst *mat.Dense, s state.State) { dst.Set(0, 0, -s.X("x")) })
+			}
+			sim.Algorithm.Newton.Tolerance = 1e-8
+			sim.SetTimespan(0, 2, 20)
+			sim.Begin()
+			time, x := sim.Results("time"), sim.Results("x")
+			dk, dx0 := sim.Sensitivity("x", "k"), sim.SensitivityX0("x", "x")
+			for i, tm := range time {
+				e := math.Exp(-k * tm)
+				if math.Abs(x[i]-x0*e) > solver.tol || math.Abs(dk[i]+tm*x0*e) > solver.tol || math.Abs(dx0[i]-e) > solver.tol {
+					t.Errorf("%s (analytic %t) t=%g: got x=%g, ∂x/∂k=%g, ∂x/∂x(0)=%g. want %g, %g, %g",
+						solver.name, analytic, tm, x[i], dk[i], dx0[i], x0*e, -tm*x0*e, e)
+				}
+			}
+		}
+	}
+}
+
+// Sparsity patterns of the model are repeated for sensitivities so
+// that large augmented systems are solved iteratively.
+func TestSensitivitySparse(t *testing.T) {
+	diffs, x0, pattern := chainModel(30)
+	run := func(sparse bool) *Simulation {
+		sim := New()
+		sim.Solver = NewtonRaphsonSolver
+		sim.Algorithm.Newton.Tolerance = 1e-10
+		sim.Algorithm.Newton.DirectMax = 20
+		sim.SetDiffFromMap(diffs)
+		sim.SetX0FromMap(x0)
+		sim.SetSensitivity(nil, []state.Symbol{"c010"})
+		if sparse {
+			sim.SetJacobianSparsity(pattern)
+		}
+		sim.SetTimespan(0, 0.5, 10)
+		sim.Begin()
+		return sim
+	}
+	dense, sparse := run(false), run(true)
+	if sparse.sparsity == nil || sparse.sparsity.n != 60 {
+		t.Fatal("expected sparsity of augmented system")
+	}
+	for _, x := range []state.Symbol{"c009", "c010", "c011"} {
+		want, got := dense.SensitivityX0(x, "c010"), sparse.SensitivityX0(x, "c010")
+		for i := range want {
+			if math.Abs(got[i]-want[i]) > 1e-6 {
+				t.Errorf("∂%s/∂c010(0): sparse newton got %g, dense got %g", x, got[i], want[i])
+			}
+		}
+	}
+}
+
+// Sensitivities of a coupled system agree with
+// finite differences of simulation results.
+func TestSensitivityFiniteDifference(t *testing.T) {
+	params := map[state.Symbol]float64{"a": 1.5, "b": 0.8}
+	run := func(p map[state.Symbol]float64, sens bool) *Simulation {
+		sim := New()
+		sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+			"prey": func(s state.State) float64 { return s.X("prey") * (s.P("a") - s.X("pred")) },
+			"pred": func(s state.State) float64 { return s.X("pred") * (s.X("prey") - s.P("b")) },
+		})
+		sim.SetX0FromMap(map[state.Symbol]float64{"prey": 1, "pred": 0.5})
+		sim.SetParamsFromMap(p)
+		if sens {
+			sim.SetSensitivity([]state.Symbol{"a", "b"}, []state.Symbol{"pred"})
+		}
+		sim.SetTimespan(0, 3, 300)
+		sim.Begin()
+		return sim
+	}
+	sim := run(params, true)
+	const h = 1e-6
+	for _, p := range []state.Symbol{"a", "b"} {
+		perturbed := map[state.Symbol]float64{"a": params["a"], "b": params["b"]}
+		perturbed[p] += h
+		simh := run(perturbed, false)
+		for _, x := range []state.Symbol{"prey", "pred"} {
+			got := sim.Sensitivity(x, p)
+			f0, f1 := sim.Results(x), simh.Results(x)
+			n := len(got) - 1
+			want := (f1[n] - f0[n]) / h
+			if math.Abs(got[n]-want) > 1e-4*math.Max(1, math.Abs(want)) {
+				t.Errorf("∂%s/∂%s: got %g, want %g", x, p, got[n], want)
+			}
+		}
+	}
+}
+
+func TestSensitivityErrors(t *testing.T) {
+	sim := newWorkingSim()
+	sim.SetSensitivity([]state.Symbol{"k"}, nil)
+	if err := recoverSimTest(sim); err == nil {
+		t.Error("expected panic for sensitivity of parameter not set")
+	}
+	sim = newWorkingSim()
+	sim.SetSensitivity(nil, []state.Symbol{"y"})
+	if err := recoverSimTest(sim); err == nil {
+		t.Error("expected panic for sensitivity of initial value of non existent X symbol")
+	}
+	sim = newWorkingSim()
+	sim.SetSensitivity(nil, []state.Symbol{"x"})
+	sim.Begin()
+	if err := recoverSimResults(sim, sensitivitySymbol("x", "k")); err == nil {
+		t.Error("expected panic for results of sensitivity not computed")
+	}
+}
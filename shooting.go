@@ -0,0 +1,231 @@
+package godesim
+
+import (
+	"math"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// BoundaryCondition is a residual of the states at the start and end of
+// the Timespan which is zero when the condition is satisfied. i.e. y(end) = 1:
+//  func(start, end state.State) float64 { return end.X("y") - 1 }
+type BoundaryCondition func(start, end state.State) float64
+
+// Shooting solves boundary value problems by iterating on unknown initial X values
+// with Newton's method until boundary conditions are satisfied. Known initial values
+// are those of the simulation's initial State.
+//
+// Single shooting integrates the whole Timespan for each iterate. Multiple shooting splits
+// the Timespan in Segments, also iterating on the X values at segment boundaries so that
+// the trajectory is continuous, which is better conditioned for unstable systems.
+// Events are ignored while shooting and sensitivities are not supported.
+type Shooting struct {
+	// Unknown are the X symbols whose initial values are solved for.
+	Unknown []state.Symbol
+	// Conditions must be as many as Unknown.
+	Conditions []BoundaryCondition
+	// Segments is the amount of multiple shooting segments. Default is 1 (single shooting).
+	Segments int
+	// Tolerance is the largest absolute residual of a solution. Default is 1e-8.
+	Tolerance float64
+	// IterationMax is the maximum amount of Newton iterations. Default is 50.
+	IterationMax int
+}
+
+// ShootingResult contains the solution of a boundary value problem.
+type ShootingResult struct {
+	// X0 contains the solved initial values of Unknown symbols.
+	X0 map[state.Symbol]float64
+	// Residual is the largest absolute value of conditions and segment discontinuities.
+	Residual   float64
+	Iterations int
+	Converged  bool
+}
+
+// Solve solves the boundary value problem and runs sim from the solved initial values
+// so that it's results are available. sim must be ready to Begin and not have run.
+// Solved initial values of Unknown symbols are set in sim's State. For unstable systems
+// the final run may drift from the multiple shooting trajectory, in which case
+// its Timespan should be refined.
+func (sh Shooting) Solve(sim *Simulation) ShootingResult {
+	if len(sim.results) > 0 {
+		throwf("Shooting: simulation results not empty")
+	}
+	if len(sh.Unknown) != len(sh.Conditions) || len(sh.Unknown) == 0 {
+		throwf("Shooting: amount of unknowns (%d) and conditions (%d) must be equal and non-zero", len(sh.Unknown), len(sh.Conditions))
+	}
+	if sim.sensitivity != nil {
+		throwf("Shooting: not supported for simulations with sensitivities enabled")
+	}
+	for _, sym := range sh.Unknown {
+		if math.IsNaN(sim.State.ConsistencyX([]state.Symbol{sym})[0]) {
+			throwf("Shooting: unknown %v not found in X symbols", sym)
+		}
+	}
+	segments := sh.Segments
+	if segments <= 0 {
+		segments = 1
+	}
+	grid := sim.Timespan.grid()
+	if segments > len(grid)-1 {
+		throwf("Shooting: %d segments exceed %d Timespan steps", segments, len(grid)-1)
+	}
+	tol := sh.Tolerance
+	if tol <= 0 {
+		tol = 1e-8
+	}
+	maxIter := sh.IterationMax
+	if maxIter <= 0 {
+		maxIter = 50
+	}
+	sp := shootingProblem{Shooting: sh, sim: sim, x0: sim.State.Clone()}
+	for k := 0; k <= segments; k++ {
+		sp.bounds = append(sp.bounds, k*(len(grid)-1)/segments)
+	}
+	sp.grid = grid
+	// initial segment starts from a single run
+	starts := make([]state.State, segments)
+	ends := make([]state.State, segments)
+	starts[0] = sp.x0
+	for k := range starts {
+		starts[k], ends[k] = sp.integrate(k, starts[k])
+		if k+1 < segments {
+			starts[k+1] = ends[k]
+		}
+	}
+	// unknowns are packed in the order of the simulation's X symbols
+	sp.x0 = starts[0]
+	z := sp.pack(starts)
+	r := sp.residual(starts, ends)
+	norm := floats.Norm(r, math.Inf(1))
+	res := ShootingResult{}
+	for ; res.Iterations < maxIter && !(norm <= tol); res.Iterations++ {
+		J := sp.jacobian(z, starts, ends, r)
+		dz, ok := solveDense(J, r)
+		if !ok {
+			break
+		}
+		// halve steps until residual decreases
+		accepted := false
+		for alpha := 1.; alpha > 1e-4; alpha /= 2 {
+			zn := floats.AddScaledTo(make([]float64, len(z)), z, -alpha, dz)
+			sn := sp.unpack(zn)
+			en := make([]state.State, segments)
+			for k := range sn {
+				_, en[k] = sp.integrate(k, sn[k])
+			}
+			rn := sp.residual(sn, en)
+			if nn := floats.Norm(rn, math.Inf(1)); nn < norm {
+				z, starts, ends, r, norm, accepted = zn, sn, en, rn, nn, true
+				break
+			}
+		}
+		if !accepted {
+			break
+		}
+	}
+	res.Residual, res.Converged = norm, norm <= tol
+	res.X0 = make(map[state.Symbol]float64, len(sh.Unknown))
+	for _, sym := range sh.Unknown {
+		res.X0[sym] = starts[0].X(sym)
+		sim.State.XSet(sym, starts[0].X(sym))
+	}
+	sim.Begin()
+	return res
+}
+
+// shootingProblem holds the segments of a boundary value problem.
+type shootingProblem struct {
+	Shooting
+	sim *Simulation
+	// x0 is the ordered initial state with known values
+	x0   state.State
+	grid []float64
+	// bounds contains the grid indices of segment boundaries
+	bounds []int
+}
+
+// integrate runs segment k from state s and returns the ordered states
+// at the segment's start and end.
+func (sp *shootingProblem) integrate(k int, s state.State) (start, end state.State) {
+	seg := *sp.sim
+	seg.results, seg.currentStep, seg.eventers = nil, 0, nil
+	// segments keep their own step length state and discard log messages,
+	// which the final run of the simulation logs.
+	seg.isolate()
+	seg.Logger = Logger{}
+	seg.Log.Results.FormatLen = 0
+	seg.State = s.Clone()
+	seg.SetTimespanPoints(sp.grid[sp.bounds[k] : sp.bounds[k+1]+1])
+	seg.Begin()
+	return seg.results[0], seg.results[len(seg.results)-1]
+}
+
+// pack returns the unknowns: initial values of Unknown symbols followed by
+// all X values at the start of each segment but the first.
+func (sp *shootingProblem) pack(starts []state.State) []float64 {
+	var z []float64
+	for _, sym := range sp.Unknown {
+		z = append(z, starts[0].X(sym))
+	}
+	for _, s := range starts[1:] {
+		z = append(z, s.XVector()...)
+	}
+	return z
+}
+
+func (sp *shootingProblem) unpack(z []float64) []state.State {
+	starts := make([]state.State, len(sp.bounds)-1)
+	starts[0] = sp.x0.Clone()
+	for i, sym := range sp.Unknown {
+		starts[0].XSet(sym, z[i])
+	}
+	z = z[len(sp.Unknown):]
+	n := sp.x0.Len()
+	for k := 1; k < len(starts); k++ {
+		starts[k] = sp.x0.Clone()
+		starts[k].SetAllX(append([]float64{}, z[:n]...))
+		starts[k].SetTime(sp.grid[sp.bounds[k]])
+		z = z[n:]
+	}
+	return starts
+}
+
+// residual returns boundary conditions followed by discontinuities at segment boundaries.
+func (sp *shootingProblem) residual(starts, ends []state.State) []float64 {
+	var r []float64
+	for _, bc := range sp.Conditions {
+		r = append(r, bc(starts[0], ends[len(ends)-1]))
+	}
+	for k := 1; k < len(starts); k++ {
+		r = append(r, floats.SubTo(make([]float64, starts[k].Len()), ends[k-1].XVector(), starts[k].XVector())...)
+	}
+	return r
+}
+
+// jacobian approximates the jacobian of the residual with forward differences.
+// Perturbing an unknown only requires integrating the segment it starts.
+func (sp *shootingProblem) jacobian(z []float64, starts, ends []state.State, r []float64) *mat.Dense {
+	J := mat.NewDense(len(r), len(z), nil)
+	n := sp.x0.Len()
+	for j := range z {
+		k := 0
+		if j >= len(sp.Unknown) {
+			k = 1 + (j-len(sp.Unknown))/n
+		}
+		h := 1e-7 * math.Max(1, math.Abs(z[j]))
+		zp := append([]float64{}, z...)
+		zp[j] += h
+		sp2 := sp.unpack(zp)
+		s, e := append([]state.State{}, starts...), append([]state.State{}, ends...)
+		s[k] = sp2[k]
+		_, e[k] = sp.integrate(k, s[k])
+		rp := sp.residual(s, e)
+		for i := range rp {
+			J.Set(i, j, (rp[i]-r[i])/h)
+		}
+	}
+	return J
+}
@@ -0,0 +1,155 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Simply supported beam under uniform load q
+//  EI w'''' = q,  w(0) = w(L) = 0,  w''(0) = w''(L) = 0
+// has deflection w = q/(24EI) (x⁴ - 2Lx³ + L³x).
+func TestShootingBeam(t *testing.T) {
+	const q, EI, L = 2., 3., 5.
+	sim := New()
+	sim.Solver = RK4Solver
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"w":     func(s state.State) float64 { return s.X("theta") },
+		"theta": func(s state.State) float64 { return s.X("M") },
+		"M":     func(s state.State) float64 { return s.X("V") },
+		"V":     func(s state.State) float64 { return q / EI },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"w": 0, "theta": 0, "M": 0, "V": 0})
+	sim.SetTimespan(0, L, 20)
+	res := Shooting{
+		Unknown: []state.Symbol{"theta", "V"},
+		Conditions: []BoundaryCondition{
+			func(_, end state.State) float64 { return end.X("w") },
+			func(_, end state.State) float64 { return end.X("M") },
+		},
+	}.Solve(sim)
+	if !res.Converged {
+		t.Fatalf("shooting did not converge: %+v", res)
+	}
+	if expected := q * L * L * L / (24 * EI); math.Abs(res.X0["theta"]-expected) > 1e-6 {
+		t.Errorf("expected θ(0)=%g, got %g", expected, res.X0["theta"])
+	}
+	exact := func(x float64) float64 { return q / (24 * EI) * (x*x*x*x - 2*L*x*x*x + L*L*L*x) }
+	w, x := sim.Results("w"), sim.Results("time")
+	for i := range x {
+		if math.Abs(w[i]-exact(x[i])) > 1e-6 {
+			t.Errorf("w(%g): expected %g, got %g", x[i], exact(x[i]), w[i])
+		}
+	}
+}
+
+// y'' = 100y with y(0) = 1, y(1) = 0 has solution y = sinh(10(1-t))/sinh(10).
+// Both initial values are unknown to exercise conditions at the start.
+func TestShootingMultiple(t *testing.T) {
+	for _, segments := range []int{1, 5} {
+		sim := New()
+		sim.Solver = RK4Solver
+		sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+			"y": func(s state.State) float64 { return s.X("v") },
+			"v": func(s state.State) float64 { return 100 * s.X("y") },
+		})
+		sim.SetX0FromMap(map[state.Symbol]float64{"y": 0, "v": 0})
+		sim.SetTimespan(0, 1, 200)
+		res := Shooting{
+			Unknown: []state.Symbol{"y", "v"},
+			Conditions: []BoundaryCondition{
+				func(start, _ state.State) float64 { return start.X("y") - 1 },
+				func(_, end state.State) float64 { return end.X("y") },
+			},
+			Segments: segments,
+		}.Solve(sim)
+		if !res.Converged {
+			t.Fatalf("%d segments: shooting did not converge: %+v", segments, res)
+		}
+		expected := -10 / math.Tanh(10)
+		if math.Abs(res.X0["v"]-expected) > 1e-4*math.Abs(expected) || math.Abs(res.X0["y"]-1) > 1e-8 {
+			t.Errorf("%d segments: expected y(0)=1, y'(0)=%g, got %v", segments, expected, res.X0)
+		}
+		y, x := sim.Results("y"), sim.Results("time")
+		for i := range x {
+			if exact := math.Sinh(10*(1-x[i])) / math.Sinh(10); math.Abs(y[i]-exact) > 1e-4 {
+				t.Errorf("%d segments: y(%g): expected %g, got %g", segments, x[i], exact, y[i])
+				break
+			}
+		}
+	}
+}
+
+// countingController counts steps it controls.
+type countingController struct {
+	IController
+	steps int
+}
+
+func (c *countingController) Step(h, errNorm float64, order int) (float64, bool) {
+	c.steps++
+	return c.IController.Step(h, errNorm, order)
+}
+
+// countingIntegrator counts the Timespan intervals it integrates.
+type countingIntegrator struct {
+	RKF45
+	intervals int
+}
+
+func (c *countingIntegrator) Solve(sim *Simulation) []state.State {
+	c.intervals++
+	return c.RKF45.Solve(sim)
+}
+
+// Segments are integrated with their own copy of the simulation's step controller and
+// integrator, which only the final run uses, and a simulation which has run is rejected.
+func TestShootingIsolation(t *testing.T) {
+	model := func() *Simulation {
+		sim := New()
+		sim.Solver = RKF45Solver
+		sim.Algorithm.Error.RelTol, sim.Algorithm.Error.AbsTol = 1e-8, 1e-8
+		sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-6, 0.5
+		sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+			"y": func(s state.State) float64 { return s.X("v") },
+			"v": func(s state.State) float64 { return -s.X("y") },
+		})
+		sim.SetX0FromMap(map[state.Symbol]float64{"y": 0, "v": 0})
+		sim.SetTimespan(0, 1, 10)
+		return sim
+	}
+	sh := Shooting{
+		Unknown:    []state.Symbol{"v"},
+		Conditions: []BoundaryCondition{func(_, end state.State) float64 { return end.X("y") - 1 }},
+		Segments:   2,
+	}
+	sim := model()
+	ctl, intg := &countingController{}, &countingIntegrator{}
+	sim.StepController, sim.Integrator = ctl, intg
+	res := sh.Solve(sim)
+	if !res.Converged {
+		t.Fatalf("shooting did not converge: %+v", res)
+	}
+	rerun := model()
+	rerun.StepController, rerun.Integrator = &countingController{}, &countingIntegrator{}
+	rerun.SetX0FromMap(map[state.Symbol]float64{"y": 0, "v": res.X0["v"]})
+	rerun.Begin()
+	if ctl.steps != rerun.StepController.(*countingController).steps {
+		t.Errorf("step controller used by segments: %d steps, final run takes %d", ctl.steps, rerun.StepController.(*countingController).steps)
+	}
+	if intg.intervals != rerun.Integrator.(*countingIntegrator).intervals {
+		t.Errorf("integrator used by segments: %d intervals, final run takes %d", intg.intervals, rerun.Integrator.(*countingIntegrator).intervals)
+	}
+	if err := recoverFromShooting(sh, sim); err == nil {
+		t.Error("expected shooting a simulation which has run to panic")
+	}
+}
+
+func recoverFromShooting(sh Shooting, sim *Simulation) (i interface{}) {
+	defer func() {
+		i = recover()
+	}()
+	sh.Solve(sim)
+	return nil
+}
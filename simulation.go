@@ -4,11 +4,13 @@
 package godesim
 
 import (
+	"math"
 	"os"
 	"time"
 
 	"github.com/soypat/godesim/state"
 	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
 )
 
 // Simulation contains dynamics of system and stores
@@ -24,11 +26,35 @@ type Simulation struct {
 	currentStep int
 	results     []state.State
 	Solver      func(sim *Simulation) []state.State
-	change      map[state.Symbol]state.Diff
-	Diffs       state.Diffs
-	inputs      map[state.Symbol]state.Input
-	eventers    []Eventer
-	events      []struct {
+	// Integrator is used instead of Solver if set. Solvers which keep
+	// state between Timespan intervals, such as RKF45, implement it.
+	Integrator Solver
+	// StepController proposes step lengths for adaptive solvers.
+	// Defaults to an IController.
+	StepController StepController
+	change         map[state.Symbol]state.Diff
+	Diffs          state.Diffs
+	inputs         map[state.Symbol]state.Input
+	jacobian       func(dst *mat.Dense, s state.State)
+	// params are the initial parameter (P) values set on Begin
+	params map[state.Symbol]float64
+	// sensitivity is set by SetSensitivity
+	sensitivity   *sensitivity
+	paramJacobian func(dst *mat.Dense, s state.State)
+	// sparsePattern is the user declared jacobian sparsity pattern
+	sparsePattern map[state.Symbol][]state.Symbol
+	sparsity      *sparsity
+	// newton holds the Newton-Raphson linear system between steps
+	newton *newtonSystem
+	stats  Stats
+	// adaptive is the step length state of function solvers (i.e. RKF45Solver)
+	adaptive AdaptiveState
+	// tolerances are per X variable error tolerances for adaptive solvers
+	tolerances tolerances
+	eventers   []Eventer
+	// diffsChanged is set if an event changed Diffs with DiffChangeFromMap
+	diffsChanged bool
+	events       []struct {
 		Label string
 		State state.State
 	}
@@ -54,8 +80,16 @@ type Config struct {
 		} `yaml:"step"`
 		Error struct {
 			// Sets max error before proceeding with adaptive iteration
-			// Step.Min should override this
+			// Step.Min should override this. Used as absolute tolerance by
+			// adaptive solvers if RelTol and AbsTol are not set.
 			Max float64 `yaml:"max"`
+			// RelTol is the relative error tolerance of X variables for adaptive solvers.
+			RelTol float64 `yaml:"rel"`
+			// AbsTol is the absolute error tolerance of X variables for adaptive solvers.
+			AbsTol float64 `yaml:"abs"`
+			// Symbols sets both tolerances for specific X variables instead of RelTol and AbsTol.
+			// Useful when X variables have different scales.
+			Symbols map[state.Symbol]Tolerance `yaml:"symbols"`
 		} `yaml:"error"`
 		// Below are numerical factors
 
@@ -65,6 +99,50 @@ type Config struct {
 		// iteration the Jacobian is calculated, which is an expensive operation.
 		// A good number may be between 10 and 100.
 		IterationMax int `yaml:"iterations"`
+		// Jacobian configures how implicit solvers obtain the jacobian of Diffs.
+		Jacobian struct {
+			// Check enables comparison of the analytic jacobian set with SetJacobian
+			// against a finite difference approximation each time it is evaluated.
+			// Mismatched entries are logged by symbol pair. Useful for debugging, slow otherwise.
+			Check bool `yaml:"check"`
+			// Tolerance is the absolute or relative difference permitted between
+			// analytic and finite difference jacobian entries. Default is 1e-4.
+			Tolerance float64 `yaml:"tolerance"`
+			// DetectSparsity enables automatic detection of the jacobian sparsity pattern
+			// on Begin if none was declared with SetJacobianSparsity. Detection perturbs
+			// each X variable so it is only worthwhile for large sparse systems.
+			DetectSparsity bool `yaml:"detect_sparsity"`
+		} `yaml:"jacobian"`
+		// Newton configures the Newton-Raphson solver's linear system.
+		Newton struct {
+			// Tolerance is the largest change of the iterate at which Newton iterations
+			// have converged. Default is 1e-5.
+			Tolerance float64 `yaml:"tolerance"`
+			// Modified enables modified Newton iterations. The factorized jacobian
+			// is reused across iterations and steps instead of being recomputed on every iteration.
+			Modified bool `yaml:"modified"`
+			// Contraction is the ratio between successive iteration errors above which
+			// convergence is considered slow and the jacobian is refactorized. Default is 0.5.
+			Contraction float64 `yaml:"contraction"`
+			// StepChange is the relative step length change above which the
+			// jacobian is refactorized. Default is 0.2.
+			StepChange float64 `yaml:"step_change"`
+			// DirectMax is the largest amount of X variables for which the linear system is solved
+			// with a LU factorization. Larger systems are solved iteratively with GMRES, preconditioned
+			// with an incomplete LU factorization if the jacobian is sparse. Default is 200.
+			DirectMax int `yaml:"direct_max"`
+			// FailureEvents adds an event to the simulation's Events each time a Newton step
+			// fails to converge or diverges. Failed steps are retried with a smaller step length.
+			FailureEvents bool `yaml:"failure_events"`
+		} `yaml:"newton"`
+		// SteadyState configures FindSteadyState.
+		SteadyState struct {
+			// Tolerance is the largest absolute value of Diffs at a steady state. Default is 1e-10.
+			Tolerance float64 `yaml:"tolerance"`
+			// IterationMax is the maximum amount of Newton iterations. Pseudo-transient
+			// continuation is allowed ten times as many. Default is 50.
+			IterationMax int `yaml:"iterations"`
+		} `yaml:"steady_state"`
 	} `yaml:"algorithm"`
 	Symbols struct {
 		// Sorts symbols for consistent logging and testing
@@ -115,13 +193,26 @@ func DefaultConfig() Config {
 //
 // Unrecoverable errors will panic. Warnings may be printed.
 func (sim *Simulation) Begin() {
+	begin := time.Now()
 	// This is step 0 of simulation
+	sim.State.SetTime(sim.Timespan.start)
+	sim.setParams(&sim.State)
+	if sim.sensitivity != nil {
+		sim.sensitivity.augment(sim)
+	}
 	for sym := range sim.inputs { // create state symbols and set them to zero in case some inputs depend on other inputs
 		sim.State.UEqual(sym, 0)
 	}
 	sim.setInputs()
 	sim.verifyPreBegin()
 
+	sim.newton = nil
+	sim.stats = Stats{}
+	sim.adaptive = AdaptiveState{}
+	sim.diffsChanged = false
+	if sim.StepController != nil {
+		sim.StepController.Reset()
+	}
 	sim.results = make([]state.State, 0, sim.Algorithm.Steps*sim.Len())
 	sim.results = append(sim.results, sim.State)
 	sim.events = make([]struct {
@@ -137,21 +228,30 @@ func (sim *Simulation) Begin() {
 	var states []state.State
 	for sim.IsRunning() {
 		sim.currentStep++
-		states = sim.Solver(sim)
+		start := time.Now()
+		states = sim.solve()
+		sim.stats.Time.Solver += time.Since(start)
+		sim.stats.addSteps(states)
 		sim.results = append(sim.results, states[1:]...)
 		sim.State = states[len(states)-1]
 		sim.setInputs()
 		if logging {
+			start = time.Now()
 			sim.logStates(states[1:])
+			sim.stats.Time.Logging += time.Since(start)
 		}
 		time.Sleep(sim.Behaviour.StepDelay)
 		if eventsOn {
+			start = time.Now()
 			sim.handleEvents()
+			sim.stats.Time.Events += time.Since(start)
 		}
 	}
-	if logging {
+	// jacobian check mismatches are reported even if results are not logged
+	if logging || sim.Algorithm.Jacobian.Check {
 		sim.Logger.flush()
 	}
+	sim.stats.Time.Total = time.Since(begin)
 }
 
 // SetX0FromMap sets simulation's initial X values from a Symbol map
@@ -178,17 +278,56 @@ func (sim *Simulation) SetDiffFromMap(m map[state.Symbol]state.Diff) {
 	sim.change = m
 }
 
+// SetJacobian sets an analytic jacobian of the Diffs system. Implicit solvers
+// use it instead of approximating the jacobian with finite differences.
+//
+// f must store ∂Diffs[i]/∂X[j] in dst.At(i, j) for the n×n dst matrix. Rows and
+// columns follow the order of State.XSymbols(), which is alphabetical
+// unless Config.Symbols.NoOrdering is set.
+func (sim *Simulation) SetJacobian(f func(dst *mat.Dense, s state.State)) {
+	sim.jacobian = f
+}
+
 // SetInputFromMap Sets Input (U) functions with pre-built map
 func (sim *Simulation) SetInputFromMap(m map[state.Symbol]state.Input) {
 	sim.inputs = m
 }
 
+// SetParamsFromMap sets the model parameters (P). Parameters are
+// constant during the simulation unless changed by an event and are
+// read with State.P:
+//  sim.SetParamsFromMap(map[state.Symbol]float64{"k": 0.5})
+//  sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+//  	"x": func(s state.State) float64 { return -s.P("k") * s.X("x") },
+//  })
+func (sim *Simulation) SetParamsFromMap(m map[state.Symbol]float64) {
+	sim.params = make(map[state.Symbol]float64, len(m))
+	for sym, v := range m {
+		sim.params[sym] = v
+	}
+}
+
+// Params returns a copy of the parameter values set with SetParamsFromMap.
+func (sim *Simulation) Params() map[state.Symbol]float64 {
+	m := make(map[state.Symbol]float64, len(sim.params))
+	for sym, v := range sim.params {
+		m[sym] = v
+	}
+	return m
+}
+
+// Dt returns the length of the Timespan interval starting at the
+// current simulation state. Constant for evenly spaced timespans.
+func (sim *Simulation) Dt() float64 {
+	return sim.Timespan.dtAt(sim.State.Time())
+}
+
 // CurrentTime obtain simulation step variable
 func (sim *Simulation) CurrentTime() float64 {
 	return sim.results[len(sim.results)-1].Time()
 }
 
-// Results get vector of simulation results for given symbol (X or U)
+// Results get vector of simulation results for given symbol (X, U or P)
 //
 // Special case is the Simulation.Domain (default "time") symbol.
 func (sim *Simulation) Results(sym state.Symbol) []float64 {
@@ -202,6 +341,7 @@ func (sim *Simulation) Results(sym state.Symbol) []float64 {
 	}
 	symV := []state.Symbol{sym}
 	consU, consX := !floats.HasNaN(sim.State.ConsistencyU(symV)), !floats.HasNaN(sim.State.ConsistencyX(symV))
+	consP := !floats.HasNaN(sim.State.ConsistencyP(symV))
 	if consU {
 		for i, r := range sim.results {
 			vec[i] = r.U(sym)
@@ -214,10 +354,36 @@ func (sim *Simulation) Results(sym state.Symbol) []float64 {
 		}
 		return vec
 	}
-	throwf("Simulation.Results: %s not found in X or U symbols", sym)
+	if consP {
+		for i, r := range sim.results {
+			vec[i] = r.P(sym)
+		}
+		return vec
+	}
+	throwf("Simulation.Results: %s not found in X, U or P symbols", sym)
 	return nil
 }
 
+// ResultsAt returns results of sym linearly interpolated at domain values points,
+// which must lie within the simulated domain. Results at Timespan points are exact.
+func (sim *Simulation) ResultsAt(sym state.Symbol, points []float64) []float64 {
+	domain := sim.Results(sim.Domain)
+	if len(domain) == 0 {
+		throwf("Simulation.ResultsAt: no results. Did you remember to call Begin() ?")
+	}
+	lo, hi := math.Min(domain[0], domain[len(domain)-1]), math.Max(domain[0], domain[len(domain)-1])
+	tol := 1e-9 * (hi - lo)
+	clamped := make([]float64, len(points))
+	for i, p := range points {
+		if p < lo-tol || p > hi+tol {
+			throwf("Simulation.ResultsAt: %v=%g outside of simulated domain [%g, %g]", sim.Domain, p, lo, hi)
+		}
+		// points may fall outside by rounding errors
+		clamped[i] = math.Max(lo, math.Min(hi, p))
+	}
+	return interpolate(clamped, domain, sim.Results(sym))
+}
+
 // StatesCopy returns a copy of all result states. Simulation must have been run beforehand.
 func (sim *Simulation) States() (states []state.State) {
 	if sim.IsRunning() {
@@ -40,7 +40,12 @@ func (sim *Simulation) verifyPreBegin() {
 	if !sim.Symbols.NoOrdering {
 		sim.State = orderedState(sim.State)
 	}
+	if sim.sensitivity != nil {
+		sim.sensitivity.index(sim.State)
+	}
 	sim.setDiffs()
+	sim.setSparsity()
+	sim.setTolerances()
 }
 
 func (sim *Simulation) verify() {
@@ -50,7 +55,7 @@ func (sim *Simulation) verify() {
 	if sim.Len() == 0 {
 		throwf("Simulation: no step (time) vector defined")
 	}
-	if sim.Solver == nil {
+	if sim.Solver == nil && sim.Integrator == nil {
 		throwf("Simulation: expected Simulation.Solver. got nil")
 	}
 	symsX := sim.diffSymbols()             //, sim.inputSymbols()
@@ -91,7 +96,8 @@ func (sim *Simulation) IsRunning() bool {
 	if sim.currentStep < 0 {
 		return false
 	}
-	return sim.Timespan.end > sim.State.Time()+sim.Dt()*.9
+	// remaining span must be in the direction of integration
+	return (sim.Timespan.end-sim.State.Time()-sim.Dt()*.9)*sim.Dt() > 0
 }
 
 func (sim *Simulation) diffSymbols() []state.Symbol {
@@ -102,6 +108,28 @@ func (sim *Simulation) diffSymbols() []state.Symbol {
 	return syms
 }
 
+// setParams sets parameters of s in sorted order so that P is ordered.
+func (sim *Simulation) setParams(s *state.State) {
+	syms := make([]state.Symbol, 0, len(sim.params))
+	for sym := range sim.params {
+		syms = append(syms, sym)
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i] < syms[j] })
+	for _, sym := range syms {
+		s.PEqual(sym, sim.params[sym])
+	}
+}
+
+// overrideParams replaces the values of parameters set with SetParamsFromMap
+// which are present in params. Other symbols are ignored.
+func (sim *Simulation) overrideParams(params map[state.Symbol]float64) {
+	for sym, v := range params {
+		if _, ok := sim.params[sym]; ok {
+			sim.params[sym] = v
+		}
+	}
+}
+
 func (sim *Simulation) setInputs() {
 	if len(sim.inputs) == 0 {
 		return
@@ -128,6 +156,10 @@ func orderedState(s state.State) state.State {
 	for i := range syms {
 		newS.UEqual(syms[i], s.U(syms[i]))
 	}
+	syms = s.PSymbols()
+	for i := range syms {
+		newS.PEqual(syms[i], s.P(syms[i]))
+	}
 	newS.SetTime(s.Time())
 	return newS
 }
@@ -135,7 +167,7 @@ func orderedState(s state.State) state.State {
 func (sim *Simulation) setDiffs() {
 	sim.Diffs = make(state.Diffs, len(sim.change))
 	for i, sym := range sim.State.XSymbols() {
-		sim.Diffs[i] = sim.change[sym]
+		sim.Diffs[i] = sim.countedDiff(sim.change[sym])
 	}
 }
 
@@ -147,6 +179,7 @@ func (sim *Simulation) handleEvents() {
 			continue
 		}
 		err := ev(sim)
+		sim.newton = nil // event may have modified Diffs or step length
 		if err == nil { // add happened event to event list
 			sim.events = append(sim.events, struct {
 				Label string
@@ -167,19 +200,13 @@ func (sim *Simulation) handleEvents() {
 }
 
 func (sim *Simulation) logStates(states []state.State) {
-	// log state symbols
-	p := len(sim.State.USymbols())
+	// log state symbols. X columns are followed by U and P columns
 	if sim.currentStep == 0 {
+		syms := append(sim.State.XSymbols(), sim.State.USymbols()...)
+		syms = append(syms, sim.State.PSymbols()...)
 		sim.Logger.Logf("%s%s", fixLength(string(sim.Domain), sim.Log.Results.FormatLen), sim.Log.Results.Separator)
-		for i, sym := range sim.State.XSymbols() {
-			if p == 0 && i == len(sim.State.XSymbols())-1 {
-				sim.Logger.Logf("%s\n", fixLength(string(sym), sim.Log.Results.FormatLen))
-			} else {
-				sim.Logger.Logf("%s%s", fixLength(string(sym), sim.Log.Results.FormatLen), sim.Log.Results.Separator)
-			}
-		}
-		for i, sym := range sim.State.USymbols() {
-			if i == len(sim.State.USymbols())-1 {
+		for i, sym := range syms {
+			if i == len(syms)-1 {
 				sim.Logger.Logf("%s\n", fixLength(string(sym), sim.Log.Results.FormatLen))
 			} else {
 				sim.Logger.Logf("%s%s", fixLength(string(sym), sim.Log.Results.FormatLen), sim.Log.Results.Separator)
@@ -195,16 +222,10 @@ func (sim *Simulation) logStates(states []state.State) {
 	// formatter := "%2.2g%s" //fmt.Sprintf("%%%dv%s", fmtlen, sim.Log.Results.Separator)
 	for _, s := range states {
 		sim.Logger.Logf(formatter, s.Time())
-		for i, v := range s.XVector() {
-			if p == 0 && i == len(s.XVector())-1 {
-				sim.Logger.Logf(formatter[:len(formatter)-len(sim.Log.Results.Separator)]+"\n", v)
-			} else {
-				sim.Logger.Logf(formatter, v)
-			}
-
-		}
-		for i, v := range s.UVector() {
-			if i == len(s.UVector())-1 {
+		values := append(s.XVector(), s.UVector()...)
+		values = append(values, s.PVector()...)
+		for i, v := range values {
+			if i == len(values)-1 {
 				sim.Logger.Logf(formatter[:len(formatter)-len(sim.Log.Results.Separator)]+"\n", v)
 			} else {
 				sim.Logger.Logf(formatter, v)
@@ -2,6 +2,7 @@ package godesim
 
 import (
 	"math"
+	"strings"
 	"testing"
 
 	"github.com/soypat/godesim/state"
@@ -53,6 +54,115 @@ func TestQuadTime(t *testing.T) {
 		}
 	}
 }
+
+// Exponential growth integrated backward from terminal condition x(1) = e.
+// Adaptive solvers run with and without tolerances.
+func TestBackward(t *testing.T) {
+	for _, adaptive := range []bool{false, true} {
+		for _, solver := range gdsimSolvers {
+			if solver.name == "naive2" {
+				continue // does not integrate state dependent diffs
+			}
+			sim := New()
+			sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+				"x": func(s state.State) float64 { return s.X("x") },
+			})
+			sim.SetX0FromMap(map[state.Symbol]float64{"x": math.E})
+			sim.Solver = solver.f
+			sim.Algorithm.Steps = 10
+			if adaptive {
+				sim.Algorithm.Error.RelTol, sim.Algorithm.Error.AbsTol = 1e-8, 1e-8
+				sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-6, 0.1
+			}
+			sim.SetTimespan(1, 0, 10)
+			sim.Begin()
+			time, x := sim.Results("time"), sim.Results("x")
+			if end := time[len(time)-1]; math.Abs(end) > 1e-12 {
+				t.Errorf("%s: expected integration to end at 0, got %g", solver.name, end)
+			}
+			for i := range x {
+				if i > 0 && time[i] >= time[i-1] {
+					t.Errorf("%s: results not ordered in direction of integration", solver.name)
+					break
+				}
+				if want := math.Exp(time[i]); math.Abs(x[i]-want) > 2e-2 {
+					t.Errorf("%s: got x=%g, want %g at time %g", solver.name, x[i], want, time[i])
+					break
+				}
+			}
+		}
+	}
+}
+
+// Fast and slow decay integrated over logarithmic and explicit timespans.
+func TestNonUniformTimespan(t *testing.T) {
+	solution := func(time float64) float64 { return math.Exp(-1e3*time) + math.Exp(-time) }
+	for _, setTimespan := range []func(sim *Simulation){
+		func(sim *Simulation) { sim.SetTimespanLog(1e-5, 10, 30) },
+		func(sim *Simulation) { sim.SetTimespanPoints([]float64{0, 1e-4, 1e-3, 1e-2, 0.1, 1, 5}) },
+	} {
+		for _, adaptive := range []bool{false, true} {
+			sim := New()
+			sim.Solver = RKF45Solver
+			sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+				"fast": func(s state.State) float64 { return -1e3 * s.X("fast") },
+				"slow": func(s state.State) float64 { return -s.X("slow") },
+			})
+			setTimespan(sim)
+			t0 := sim.Timespan.start
+			sim.SetX0FromMap(map[state.Symbol]float64{"fast": math.Exp(-1e3 * t0), "slow": math.Exp(-t0)})
+			sim.Algorithm.Steps = 20
+			if adaptive {
+				sim.Algorithm.Error.RelTol, sim.Algorithm.Error.AbsTol = 1e-8, 1e-10
+				sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-9, 1
+			}
+			sim.Begin()
+			time, fast, slow := sim.Results("time"), sim.Results("fast"), sim.Results("slow")
+			points := sim.Timespan.points
+			if !adaptive && len(time) != sim.Algorithm.Steps*(len(points)-1)+1 {
+				t.Fatalf("expected %d results, got %d", sim.Algorithm.Steps*(len(points)-1)+1, len(time))
+			}
+			k := 0
+			for i := range time {
+				if math.Abs(time[i]-points[k]) < 1e-12*math.Max(1, points[k]) {
+					k++
+				}
+				got, want := fast[i]+slow[i], solution(time[i])
+				if !adaptive {
+					// fixed steps are too long for the fast decay on late intervals
+					got, want = slow[i], math.Exp(-time[i])
+				}
+				if math.Abs(got-want) > 1e-5 {
+					t.Errorf("adaptive=%t: got %g, want %g at time %g", adaptive, got, want, time[i])
+					break
+				}
+			}
+			if k != len(points) {
+				t.Errorf("adaptive=%t: results contain %d of %d timespan points", adaptive, k, len(points))
+			}
+		}
+	}
+}
+
+func TestTimespanPointErrors(t *testing.T) {
+	for _, points := range [][]float64{{1}, {0, 1, 1}, {0, 2, 1}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for points %v", points)
+				}
+			}()
+			var ts Timespan
+			ts.SetTimespanPoints(points)
+		}()
+	}
+	var ts Timespan
+	ts.SetTimespanPoints([]float64{3, 2, 0})
+	if dt := ts.dtAt(2); dt != -2 {
+		t.Errorf("backward points: expected interval length -2, got %g", dt)
+	}
+}
+
 func TestQuadratic(t *testing.T) {
 	for _, solver := range gdsimSolvers {
 		Dtheta := func(s state.State) float64 {
@@ -127,6 +237,73 @@ func TestInputSimple(t *testing.T) {
 	}
 }
 
+// Parameter a is doubled by an event halfway through.
+// Solution is theta(t) = t for t<=0.5 and 2*t - 0.5 afterwards.
+func TestParams(t *testing.T) {
+	newSim := func() *Simulation {
+		sim := New()
+		sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+			"theta": func(s state.State) float64 { return s.P("a") },
+		})
+		sim.SetX0FromMap(map[state.Symbol]float64{"theta": 0})
+		sim.SetParamsFromMap(map[state.Symbol]float64{"a": 1, "b": 0})
+		sim.SetTimespan(0, 1, 10)
+		return sim
+	}
+	sim := newSim()
+	sim.AddEventHandlers(TypicalEventer{
+		label: "double a",
+		action: func(s state.State) func(*Simulation) error {
+			if s.Time() >= 0.5-1e-9 {
+				return ParamChangeFromMap(map[state.Symbol]float64{"a": 2})
+			}
+			return nil
+		},
+	})
+	sim.Log.Results.FormatLen, sim.Log.Results.Separator = 6, ","
+	out := &strings.Builder{}
+	sim.Logger.Output = out
+	sim.Begin()
+	if header := strings.SplitN(out.String(), "\n", 2)[0]; header != "time  ,theta ,a     ,b     " {
+		t.Errorf("unexpected log header %q", header)
+	}
+	time, theta, a := sim.Results("time"), sim.Results("theta"), sim.Results("a")
+	for i, tm := range time {
+		wantTheta, wantA := tm, 1.
+		if tm > 0.5+1e-9 {
+			wantTheta, wantA = 2*tm-0.5, 2
+		}
+		if math.Abs(theta[i]-wantTheta) > 1e-12 || a[i] != wantA {
+			t.Errorf("t=%g: expected theta=%g, a=%g. got %g, %g", tm, wantTheta, wantA, theta[i], a[i])
+		}
+	}
+	if p := sim.Params(); p["a"] != 1 {
+		t.Errorf("event should not modify initial parameters. got a=%g", p["a"])
+	}
+
+	// unknown parameters in events are reported
+	sim = newSim()
+	sim.AddEventHandlers(TypicalEventer{
+		label: "bad",
+		action: func(s state.State) func(*Simulation) error {
+			return ParamChangeFromMap(map[state.Symbol]float64{"c": 2})
+		},
+	})
+	sim.Begin()
+	if evs := sim.Events(); len(evs) != 1 || !strings.HasPrefix(evs[0].Label, "error") {
+		t.Errorf("expected error event, got %v", evs)
+	}
+
+	// design point parameters override those set in Model
+	tbl := Sweep{
+		Model:  func(map[state.Symbol]float64) *Simulation { return newSim() },
+		Design: []map[state.Symbol]float64{{"a": 3}},
+	}.Run()
+	if row := tbl.Rows[0]; row.Err != nil || math.Abs(row.Final["theta"]-3) > 1e-12 {
+		t.Errorf("expected theta=3 for a=3, got %g (%v)", row.Final["theta"], row.Err)
+	}
+}
+
 // Stiff equation example based off https://en.wikipedia.org/wiki/Stiff_equation
 func TestNewtonRaphson_stiff(t *testing.T) {
 	// TODO change tau to -15
@@ -201,7 +378,7 @@ func TestTimespanErrors(t *testing.T) {
 		start, end float64
 		steps      int
 	}{
-		{start: 1., end: 0, steps: 10},
+		{start: 0, end: 1., steps: -1},
 		{start: 0, end: 1., steps: 0},
 		{start: 20., end: 20., steps: 10},
 	}
@@ -364,6 +541,24 @@ func TestBadStateDiff(t *testing.T) {
 	StateDiff(F, s)
 }
 
+func TestResultsAt(t *testing.T) {
+	sim := newWorkingSim()
+	sim.Begin()
+	// x(t) = 1 + t
+	got := sim.ResultsAt("x", []float64{0, 0.25, 1})
+	for i, want := range []float64{1, 1.25, 2} {
+		if math.Abs(got[i]-want) > 1e-12 {
+			t.Errorf("expected x=%g, got %g", want, got[i])
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for point outside of simulated domain")
+		}
+	}()
+	sim.ResultsAt("x", []float64{1.5})
+}
+
 func TestGreedyStates(t *testing.T) {
 	defer func() {
 		err := recover()
@@ -423,3 +618,23 @@ func applyFunc(sli []float64, f func(float64) float64) []float64 {
 	}
 	return res
 }
+
+func TestNilLoggerOutput(t *testing.T) {
+	sim := newWorkingSim()
+	sim.Logger.Output = nil
+	if err := recoverSimTest(sim); err != nil {
+		t.Errorf("simulation without logger output failed: %v", err)
+	}
+}
+
+// Messages are not written to Output if results are not logged.
+func TestLoggerNotFlushed(t *testing.T) {
+	sim := newWorkingSim()
+	out := &strings.Builder{}
+	sim.Logger.Output = out
+	sim.Logger.Logf("message")
+	sim.Begin()
+	if out.Len() != 0 {
+		t.Errorf("expected no output with logging disabled, got %q", out.String())
+	}
+}
@@ -0,0 +1,98 @@
+package godesim
+
+import (
+	"reflect"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Solver integrates a Simulation over one Timespan interval. Solve returns
+// the states of the interval starting with sim.State. Solvers are set
+// in Simulation.Integrator, i.e.
+//  sim.Integrator = &godesim.RKF45{}
+//
+// Solvers may keep state between calls, such as the step length of
+// adaptive solvers, so each Simulation should have it's own.
+type Solver interface {
+	Solve(sim *Simulation) []state.State
+}
+
+// SolverFunc adapts an ordinary function to the Solver interface.
+//
+//  sim.Integrator = godesim.SolverFunc(godesim.RK4Solver)
+type SolverFunc func(sim *Simulation) []state.State
+
+// Solve implements Solver
+func (f SolverFunc) Solve(sim *Simulation) []state.State { return f(sim) }
+
+// solve integrates the current Timespan interval with Integrator if set, else with Solver.
+func (sim *Simulation) solve() []state.State {
+	if sim.Integrator != nil {
+		return sim.Integrator.Solve(sim)
+	}
+	return sim.Solver(sim)
+}
+
+// copySolver returns a copy of pointer Solvers, which may keep state between
+// calls, so that it is not shared between simulations. Other Solvers are returned as is.
+func copySolver(s Solver) Solver {
+	v := reflect.ValueOf(s)
+	if s == nil || v.Kind() != reflect.Ptr || v.IsNil() {
+		return s
+	}
+	cp := reflect.New(v.Elem().Type())
+	cp.Elem().Set(v.Elem())
+	return cp.Interface().(Solver)
+}
+
+// AdaptiveState is the state adaptive solvers keep between Timespan intervals.
+// The function solvers (i.e. RKF45Solver) keep theirs in the Simulation.
+//
+// The error history of previous steps is kept by the Simulation's StepController
+// (see PIController), which is the only consumer of it and may be shared by
+// solvers of different order, and is reset on Begin. None of the solvers are
+// multistep methods so there is no multistep history to keep.
+type AdaptiveState struct {
+	h float64
+}
+
+// StepLength returns the step length the next step is attempted with.
+// It is zero before the first adaptive step.
+func (st *AdaptiveState) StepLength() float64 { return st.h }
+
+// start returns the step length to begin an interval at state s with.
+// The step length is estimated on the first call of a simulation run.
+func (st *AdaptiveState) start(sim *Simulation, s state.State, order int) float64 {
+	if st.h <= 0 || sim.currentStep <= 1 {
+		st.h = sim.initialStep(s, order)
+	}
+	return st.h
+}
+
+// RKF45 is the Runge-Kutta-Fehlberg 4(5) solver. See RKF45Solver.
+type RKF45 struct{ AdaptiveState }
+
+// Solve implements Solver
+func (r *RKF45) Solve(sim *Simulation) []state.State { return rkf45(sim, &r.AdaptiveState) }
+
+// DormandPrince is the Dormand-Prince 4(5) solver. See DormandPrinceSolver.
+type DormandPrince struct{ AdaptiveState }
+
+// Solve implements Solver
+func (d *DormandPrince) Solve(sim *Simulation) []state.State {
+	return dormandPrince(sim, &d.AdaptiveState)
+}
+
+// RKF78 is the Runge-Kutta-Fehlberg 7(8) solver. See RKF78Solver.
+type RKF78 struct{ AdaptiveState }
+
+// Solve implements Solver
+func (r *RKF78) Solve(sim *Simulation) []state.State { return rkf78(sim, &r.AdaptiveState) }
+
+// NewtonRaphson is the implicit backward Euler solver. See NewtonRaphsonSolver.
+type NewtonRaphson struct{ AdaptiveState }
+
+// Solve implements Solver
+func (n *NewtonRaphson) Solve(sim *Simulation) []state.State {
+	return newtonRaphson(sim, &n.AdaptiveState)
+}
@@ -0,0 +1,56 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Adaptive solvers must not modify Config and must give
+// the same results when reused for another run.
+func TestAdaptiveSolverState(t *testing.T) {
+	rkf45, newton := &RKF45{}, &NewtonRaphson{}
+	for _, solver := range []struct {
+		name string
+		s    Solver
+		step func() float64
+	}{{"rkf45", rkf45, rkf45.StepLength}, {"newton", newton, newton.StepLength}} {
+		var first []float64
+		for run := 0; run < 2; run++ {
+			sim := New()
+			sim.Integrator = solver.s
+			sim.Algorithm.Error.RelTol, sim.Algorithm.Error.AbsTol = 1e-6, 1e-6
+			sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-6, 1
+			sim.Algorithm.Steps = 4
+			sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+				"x": func(s state.State) float64 { return -s.X("x") },
+			})
+			sim.SetX0FromMap(map[state.Symbol]float64{"x": 1})
+			sim.SetTimespan(0, 2, 5)
+			sim.Begin()
+			if sim.Algorithm.Steps != 4 {
+				t.Errorf("%s: Config.Algorithm.Steps modified to %d", solver.name, sim.Algorithm.Steps)
+			}
+			if sim.Algorithm.Error.Max != 0 || sim.Algorithm.IterationMax != 0 {
+				t.Errorf("%s: Config.Algorithm Error.Max and IterationMax modified to %g, %d", solver.name, sim.Algorithm.Error.Max, sim.Algorithm.IterationMax)
+			}
+			if solver.step() <= 0 {
+				t.Errorf("%s: expected positive step length after run", solver.name)
+			}
+			x := sim.Results("x")
+			if run == 0 {
+				first = x
+				continue
+			}
+			if len(x) != len(first) {
+				t.Fatalf("%s: reused solver gave %d results, first run %d", solver.name, len(x), len(first))
+			}
+			for i := range x {
+				if math.Abs(x[i]-first[i]) > 1e-12 {
+					t.Errorf("%s: reused solver result %g differs from first run %g", solver.name, x[i], first[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package godesim
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/mat"
+)
+
+// SetJacobianSparsity declares the sparsity pattern of the jacobian of the
+// Diffs system. Each X symbol maps to the X symbols its Diff depends on.
+// X symbols not present in the map are assumed to depend on no X symbol.
+//
+// With a sparsity pattern set implicit solvers approximate the jacobian with
+// Curtis-Powell-Reid column coloring, which requires as many Diffs evaluations
+// as there are colors instead of one per X symbol, and store it as a sparse matrix.
+// Systems larger than Config.Algorithm.Newton.DirectMax are then solved with GMRES
+// preconditioned by an incomplete LU factorization. Entries of an analytic jacobian
+// set with SetJacobian outside the pattern are ignored.
+// The pattern must hold for Diffs set by events during simulation too.
+func (sim *Simulation) SetJacobianSparsity(m map[state.Symbol][]state.Symbol) {
+	sim.sparsePattern = m
+}
+
+// sparsity holds the structure of a sparse jacobian and
+// the coloring of its columns.
+type sparsity struct {
+	n int
+	// rows contains sorted column indices of nonzero entries for each row
+	rows [][]int
+	// cols contains sorted row indices of nonzero entries for each column
+	cols [][]int
+	// colors are groups of columns which do not share nonzero rows (structurally orthogonal)
+	colors [][]int
+}
+
+// setSparsity builds sim.sparsity from declared pattern or detects it if so configured.
+// Called once Diffs are set.
+func (sim *Simulation) setSparsity() {
+	sim.sparsity = nil
+	switch {
+	case sim.sparsePattern != nil:
+		syms := sim.State.XSymbols()
+		if sim.sensitivity != nil {
+			syms = sim.sensitivity.modelSymbols(sim.State)
+		}
+		idx := make(map[state.Symbol]int, len(syms))
+		for i, sym := range syms {
+			idx[sym] = i
+		}
+		rows := make([][]int, len(syms))
+		for sym, deps := range sim.sparsePattern {
+			i, ok := idx[sym]
+			if !ok {
+				throwf("SetJacobianSparsity: %v not found in X symbols", sym)
+			}
+			for _, dep := range deps {
+				j, ok := idx[dep]
+				if !ok {
+					throwf("SetJacobianSparsity: %v dependency %v not found in X symbols", sym, dep)
+				}
+				rows[i] = append(rows[i], j)
+			}
+		}
+		if sim.sensitivity != nil {
+			sim.sparsity = sim.sensitivity.sparsity(sim.State.Len(), rows)
+			break
+		}
+		sim.sparsity = newSparsity(len(syms), rows)
+	case sim.sensitivity != nil:
+		// sensitivities depend on all model variables. see SetSensitivity
+	case sim.Algorithm.Jacobian.DetectSparsity:
+		sim.sparsity = detectSparsity(sim.Diffs, sim.State)
+	}
+}
+
+// newSparsity creates a sparsity structure from row nonzero column indices
+// and colors it's columns using a greedy algorithm.
+func newSparsity(n int, rows [][]int) *sparsity {
+	sp := &sparsity{n: n, rows: make([][]int, n), cols: make([][]int, n)}
+	for i := range rows {
+		sp.rows[i] = uniqueSorted(rows[i])
+		for _, j := range sp.rows[i] {
+			sp.cols[j] = append(sp.cols[j], i)
+		}
+	}
+	// Curtis-Powell-Reid: a column joins the first color
+	// none of whose columns have a nonzero in the same rows.
+	var usedRows [][]bool
+	for j := 0; j < n; j++ {
+		if len(sp.cols[j]) == 0 {
+			continue // no need to evaluate columns without entries
+		}
+		color := -1
+		for c := range sp.colors {
+			free := true
+			for _, i := range sp.cols[j] {
+				if usedRows[c][i] {
+					free = false
+					break
+				}
+			}
+			if free {
+				color = c
+				break
+			}
+		}
+		if color < 0 {
+			color = len(sp.colors)
+			sp.colors = append(sp.colors, nil)
+			usedRows = append(usedRows, make([]bool, n))
+		}
+		sp.colors[color] = append(sp.colors[color], j)
+		for _, i := range sp.cols[j] {
+			usedRows[color][i] = true
+		}
+	}
+	return sp
+}
+
+// detectSparsity finds nonzero jacobian entries by perturbing each X variable at
+// state s and at a randomly perturbed copy of s. Entries which are zero at both points
+// are assumed to be structurally zero.
+func detectSparsity(F state.Diffs, s state.State) *sparsity {
+	n := s.Len()
+	rnd := rand.New(rand.NewSource(1))
+	rows := make([][]int, n)
+	x0 := s.XVector()
+	x1 := s.XVector()
+	for j := range x1 {
+		x1[j] += (1 + math.Abs(x1[j])) * 1e-2 * (rnd.Float64() - 0.5)
+	}
+	for _, x := range [][]float64{x0, x1} {
+		sx := s.Clone()
+		sx.SetAllX(append([]float64{}, x...))
+		f0 := make([]float64, n)
+		for i := range F {
+			f0[i] = F[i](sx)
+		}
+		for j := 0; j < n; j++ {
+			xj := x[j]
+			h := math.Sqrt(dlamchE) * math.Max(1, math.Abs(xj))
+			sxp := s.Clone()
+			xp := append([]float64{}, x...)
+			xp[j] = xj + h
+			sxp.SetAllX(xp)
+			for i := range F {
+				if F[i](sxp) != f0[i] {
+					rows[i] = append(rows[i], j)
+				}
+			}
+		}
+	}
+	return newSparsity(n, rows)
+}
+
+// jacobian approximates the jacobian of F at s using forward finite differences.
+// Columns of the same color are perturbed simultaneously and only the Diffs
+// of rows with entries in the color's columns are evaluated.
+func (sp *sparsity) jacobian(dst *sparseMatrix, F state.Diffs, s state.State) {
+	x := s.XVector()
+	f0 := make([]float64, sp.n)
+	for i := range F {
+		f0[i] = F[i](s)
+	}
+	step := make([]float64, sp.n)
+	for _, color := range sp.colors {
+		xp := append([]float64{}, x...)
+		for _, j := range color {
+			step[j] = math.Sqrt(dlamchE) * math.Max(1, math.Abs(x[j]))
+			xp[j] += step[j]
+		}
+		sx := s.Clone()
+		sx.SetAllX(xp)
+		for _, j := range color {
+			// columns of a color share no rows so each Diff is evaluated at most once
+			for _, i := range sp.cols[j] {
+				dst.set(i, j, (F[i](sx)-f0[i])/step[j])
+			}
+		}
+	}
+}
+
+// sparseMatrix is a square matrix stored in compressed sparse row format.
+// It implements gonum/exp/linsolve's MulVecToer.
+type sparseMatrix struct {
+	n      int
+	rowptr []int
+	colidx []int
+	data   []float64
+}
+
+// newSparseMatrix creates a zero valued matrix with the structure of sp.
+// If diagonal is true diagonal entries are part of the structure.
+func (sp *sparsity) newSparseMatrix(diagonal bool) *sparseMatrix {
+	m := &sparseMatrix{n: sp.n, rowptr: make([]int, sp.n+1)}
+	for i, row := range sp.rows {
+		if diagonal {
+			row = uniqueSorted(append(append([]int{}, row...), i))
+		}
+		m.colidx = append(m.colidx, row...)
+		m.rowptr[i+1] = len(m.colidx)
+	}
+	m.data = make([]float64, len(m.colidx))
+	return m
+}
+
+// index returns position of entry i,j in data. Returns -1 if entry is structurally zero.
+func (m *sparseMatrix) index(i, j int) int {
+	cols := m.colidx[m.rowptr[i]:m.rowptr[i+1]]
+	k := sort.SearchInts(cols, j)
+	if k == len(cols) || cols[k] != j {
+		return -1
+	}
+	return m.rowptr[i] + k
+}
+
+func (m *sparseMatrix) set(i, j int, v float64) {
+	k := m.index(i, j)
+	if k < 0 {
+		throwf("sparse matrix: entry %d,%d not in sparsity pattern", i, j)
+	}
+	m.data[k] = v
+}
+
+// At returns the value of entry i,j
+func (m *sparseMatrix) At(i, j int) float64 {
+	k := m.index(i, j)
+	if k < 0 {
+		return 0
+	}
+	return m.data[k]
+}
+
+// MulVecTo computes A*x or Aᵀ*x and stores the result into dst.
+func (m *sparseMatrix) MulVecTo(dst *mat.VecDense, trans bool, x mat.Vector) {
+	if dst.Len() != m.n || x.Len() != m.n {
+		throwf("sparse matrix: mismatched vector length")
+	}
+	if trans {
+		dst.Zero()
+		for i := 0; i < m.n; i++ {
+			xi := x.AtVec(i)
+			for k := m.rowptr[i]; k < m.rowptr[i+1]; k++ {
+				j := m.colidx[k]
+				dst.SetVec(j, dst.AtVec(j)+m.data[k]*xi)
+			}
+		}
+		return
+	}
+	for i := 0; i < m.n; i++ {
+		var sum float64
+		for k := m.rowptr[i]; k < m.rowptr[i+1]; k++ {
+			sum += m.data[k] * x.AtVec(m.colidx[k])
+		}
+		dst.SetVec(i, sum)
+	}
+}
+
+// residualJacobian stores I - h*J in dst, where J has the same structure as dst
+// without necessarily containing the diagonal.
+func (m *sparseMatrix) residualJacobian(h float64, J *sparseMatrix) {
+	for i := 0; i < m.n; i++ {
+		for k := m.rowptr[i]; k < m.rowptr[i+1]; k++ {
+			j := m.colidx[k]
+			v := -h * J.At(i, j)
+			if i == j {
+				v++
+			}
+			m.data[k] = v
+		}
+	}
+}
+
+// gather sets the structural entries of m from dense matrix d.
+// Entries of d outside the structure are ignored.
+func (m *sparseMatrix) gather(d *mat.Dense) {
+	for i := 0; i < m.n; i++ {
+		for k := m.rowptr[i]; k < m.rowptr[i+1]; k++ {
+			m.data[k] = d.At(i, m.colidx[k])
+		}
+	}
+}
+
+// ilu is an incomplete LU factorization with zero fill-in, ILU(0), of a sparse
+// matrix A. L (unit lower triangular) and U share the structure of A and are
+// stored in lu. Used to precondition iterative solves.
+type ilu struct {
+	lu *sparseMatrix
+	// diag contains the position of diagonal entries in lu.data
+	diag []int
+}
+
+// newILU factorizes a, which must contain it's diagonal in it's structure.
+// ok is false if a zero pivot is found.
+func newILU(a *sparseMatrix) (f *ilu, ok bool) {
+	lu := &sparseMatrix{n: a.n, rowptr: a.rowptr, colidx: a.colidx, data: append([]float64{}, a.data...)}
+	f = &ilu{lu: lu, diag: make([]int, a.n)}
+	for i := 0; i < a.n; i++ {
+		f.diag[i] = lu.index(i, i)
+		if f.diag[i] < 0 {
+			return nil, false
+		}
+	}
+	for i := 1; i < a.n; i++ {
+		for kk := lu.rowptr[i]; kk < f.diag[i]; kk++ {
+			k := lu.colidx[kk]
+			pivot := lu.data[f.diag[k]]
+			if pivot == 0 {
+				return nil, false
+			}
+			lu.data[kk] /= pivot
+			// a_ij -= l_ik * u_kj for entries of row i in the structure
+			for jj := kk + 1; jj < lu.rowptr[i+1]; jj++ {
+				if kj := lu.index(k, lu.colidx[jj]); kj >= 0 {
+					lu.data[jj] -= lu.data[kk] * lu.data[kj]
+				}
+			}
+		}
+	}
+	if lu.data[f.diag[a.n-1]] == 0 {
+		return nil, false
+	}
+	return f, true
+}
+
+// solve stores the solution of L*U*x = rhs, or (L*U)ᵀ*x = rhs if trans is true, in dst.
+func (f *ilu) solve(dst *mat.VecDense, trans bool, rhs mat.Vector) error {
+	lu, n := f.lu, f.lu.n
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = rhs.AtVec(i)
+	}
+	if !trans {
+		for i := 0; i < n; i++ {
+			for k := lu.rowptr[i]; k < f.diag[i]; k++ {
+				x[i] -= lu.data[k] * x[lu.colidx[k]]
+			}
+		}
+		for i := n - 1; i >= 0; i-- {
+			for k := f.diag[i] + 1; k < lu.rowptr[i+1]; k++ {
+				x[i] -= lu.data[k] * x[lu.colidx[k]]
+			}
+			x[i] /= lu.data[f.diag[i]]
+		}
+	} else {
+		// Uᵀ*z = rhs then Lᵀ*x = z, scattering by rows of L and U
+		for i := 0; i < n; i++ {
+			x[i] /= lu.data[f.diag[i]]
+			for k := f.diag[i] + 1; k < lu.rowptr[i+1]; k++ {
+				x[lu.colidx[k]] -= lu.data[k] * x[i]
+			}
+		}
+		for i := n - 1; i >= 0; i-- {
+			for k := lu.rowptr[i]; k < f.diag[i]; k++ {
+				x[lu.colidx[k]] -= lu.data[k] * x[i]
+			}
+		}
+	}
+	for i, v := range x {
+		dst.SetVec(i, v)
+	}
+	return nil
+}
+
+func uniqueSorted(a []int) []int {
+	if len(a) == 0 {
+		return a
+	}
+	sort.Ints(a)
+	k := 1
+	for i := 1; i < len(a); i++ {
+		if a[i] != a[k-1] {
+			a[k] = a[i]
+			k++
+		}
+	}
+	return a[:k]
+}
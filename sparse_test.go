@@ -0,0 +1,196 @@
+package godesim
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/mat"
+)
+
+// diffusion chain with quadratic decay. Jacobian is tridiagonal.
+func chainModel(n int) (map[state.Symbol]state.Diff, map[state.Symbol]float64, map[state.Symbol][]state.Symbol) {
+	syms := make([]state.Symbol, n)
+	for i := range syms {
+		syms[i] = state.Symbol(fmt.Sprintf("c%03d", i))
+	}
+	diffs := make(map[state.Symbol]state.Diff, n)
+	x0 := make(map[state.Symbol]float64, n)
+	pattern := make(map[state.Symbol][]state.Symbol, n)
+	for loopi := range syms {
+		i := loopi
+		pattern[syms[i]] = []state.Symbol{syms[i]}
+		if i > 0 {
+			pattern[syms[i]] = append(pattern[syms[i]], syms[i-1])
+		}
+		if i < n-1 {
+			pattern[syms[i]] = append(pattern[syms[i]], syms[i+1])
+		}
+		diffs[syms[i]] = func(s state.State) float64 {
+			var left, right float64
+			if i > 0 {
+				left = s.X(syms[i-1])
+			}
+			if i < n-1 {
+				right = s.X(syms[i+1])
+			}
+			c := s.X(syms[i])
+			return 10*(left-2*c+right) - c*c
+		}
+		x0[syms[i]] = math.Sin(math.Pi * float64(i) / float64(n-1))
+	}
+	return diffs, x0, pattern
+}
+
+// chainJacobian is the analytic jacobian of chainModel.
+func chainJacobian(dst *mat.Dense, s state.State) {
+	x := s.XVector()
+	n := len(x)
+	dst.Zero()
+	for i := 0; i < n; i++ {
+		dst.Set(i, i, -20-2*x[i])
+		if i > 0 {
+			dst.Set(i, i-1, 10)
+		}
+		if i < n-1 {
+			dst.Set(i, i+1, 10)
+		}
+	}
+}
+
+func TestSparsityColoring(t *testing.T) {
+	const n = 10
+	rows := make([][]int, n)
+	for i := range rows {
+		for j := i - 1; j <= i+1; j++ {
+			if j >= 0 && j < n {
+				rows[i] = append(rows[i], j)
+			}
+		}
+	}
+	sp := newSparsity(n, rows)
+	if len(sp.colors) != 3 {
+		t.Errorf("expected 3 colors for tridiagonal matrix, got %d", len(sp.colors))
+	}
+	colored := 0
+	for _, color := range sp.colors {
+		rowUsed := make([]bool, n)
+		for _, j := range color {
+			colored++
+			for _, i := range sp.cols[j] {
+				if rowUsed[i] {
+					t.Errorf("columns of same color share row %d", i)
+				}
+				rowUsed[i] = true
+			}
+		}
+	}
+	if colored != n {
+		t.Errorf("expected %d colored columns, got %d", n, colored)
+	}
+}
+
+func TestSparseJacobian(t *testing.T) {
+	diffs, x0, pattern := chainModel(12)
+	sim := New()
+	sim.SetDiffFromMap(diffs)
+	sim.SetX0FromMap(x0)
+	sim.SetJacobianSparsity(pattern)
+	sim.SetTimespan(0, 1, 1)
+	sim.verifyPreBegin()
+	n := sim.State.Len()
+	sparse := sim.sparsity.newSparseMatrix(false)
+	sim.sparsity.jacobian(sparse, sim.Diffs, sim.State)
+	dense := mat.NewDense(n, n, nil)
+	state.Jacobian(dense, sim.Diffs, sim.State, nil)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if math.Abs(dense.At(i, j)-sparse.At(i, j)) > 1e-6 {
+				t.Errorf("sparse jacobian entry %d,%d: got %g, want %g", i, j, sparse.At(i, j), dense.At(i, j))
+			}
+		}
+	}
+	detected := detectSparsity(sim.Diffs, sim.State)
+	if len(detected.colors) != len(sim.sparsity.colors) {
+		t.Errorf("detected sparsity has %d colors, declared has %d", len(detected.colors), len(sim.sparsity.colors))
+	}
+}
+
+func TestNewtonSparse(t *testing.T) {
+	diffs, x0, pattern := chainModel(30)
+	run := func(setup func(sim *Simulation)) *Simulation {
+		sim := New()
+		sim.Solver = NewtonRaphsonSolver
+		sim.SetDiffFromMap(diffs)
+		sim.SetX0FromMap(x0)
+		sim.SetTimespan(0, 0.5, 10)
+		setup(sim)
+		sim.Begin()
+		return sim
+	}
+	dense := run(func(*Simulation) {})
+	declared := run(func(sim *Simulation) { sim.SetJacobianSparsity(pattern) })
+	detected := run(func(sim *Simulation) { sim.Algorithm.Jacobian.DetectSparsity = true })
+	analytic := run(func(sim *Simulation) {
+		sim.SetJacobianSparsity(pattern)
+		sim.SetJacobian(chainJacobian)
+	})
+	if declared.sparsity == nil || detected.sparsity == nil || analytic.sparsity == nil {
+		t.Fatal("expected sparse jacobian to be used")
+	}
+	for sym := range x0 {
+		want := dense.Results(sym)
+		for _, sim := range []*Simulation{declared, detected, analytic} {
+			got := sim.Results(sym)
+			for i := range want {
+				if math.Abs(got[i]-want[i]) > 1e-4 {
+					t.Errorf("%s: sparse newton got %g, dense got %g", sym, got[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+// ILU(0) of a tridiagonal matrix has no fill-in so it is an exact factorization.
+func TestILUTridiagonal(t *testing.T) {
+	const n = 6
+	rows := make([][]int, n)
+	for i := range rows {
+		for j := i - 1; j <= i+1; j++ {
+			if j >= 0 && j < n && j != i {
+				rows[i] = append(rows[i], j)
+			}
+		}
+	}
+	a := newSparsity(n, rows).newSparseMatrix(true)
+	dense := mat.NewDense(n, n, nil)
+	for i := 0; i < n; i++ {
+		for _, j := range append(rows[i], i) {
+			v := float64(1 + i + 2*j)
+			if i == j {
+				v = 10
+			}
+			a.set(i, j, v)
+			dense.Set(i, j, v)
+		}
+	}
+	f, ok := newILU(a)
+	if !ok {
+		t.Fatal("unexpected zero pivot")
+	}
+	b := mat.NewVecDense(n, []float64{1, -2, 3, 0, 5, 1})
+	for _, trans := range []bool{false, true} {
+		x := mat.NewVecDense(n, nil)
+		f.solve(x, trans, b)
+		var got mat.VecDense
+		if trans {
+			got.MulVec(dense.T(), x)
+		} else {
+			got.MulVec(dense, x)
+		}
+		if !mat.EqualApprox(&got, b, 1e-12) {
+			t.Errorf("trans=%v: expected A*x = b, got %v", trans, mat.Formatted(got.T()))
+		}
+	}
+}
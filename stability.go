@@ -0,0 +1,110 @@
+package godesim
+
+import (
+	"math"
+	"math/cmplx"
+	"sort"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Modes contains the eigen decomposition of the jacobian of Diffs at a state.
+// Modes are sorted by decreasing real part so the least stable mode is first.
+type Modes struct {
+	// State at which the jacobian was evaluated.
+	State state.State
+	// Eigenvalues of the jacobian.
+	Eigenvalues []complex128
+	// Eigenvectors contains the eigenvector of each eigenvalue as a column.
+	// Rows are labelled by X.
+	Eigenvectors *mat.CDense
+	X            []state.Symbol
+	// Damping contains the damping ratio -Re(λ)/|λ| of each eigenvalue.
+	// Negative for unstable modes and zero for zero eigenvalues.
+	Damping []float64
+	// Frequency contains the natural frequency |λ| of each eigenvalue.
+	Frequency []float64
+}
+
+// Stable returns true if all eigenvalues have negative real part.
+func (m Modes) Stable() bool {
+	return m.MaxReal() < 0
+}
+
+// MaxReal returns the largest real part of eigenvalues, which is
+// positive if the state is unstable.
+func (m Modes) MaxReal() float64 {
+	return real(m.Eigenvalues[0])
+}
+
+// Mode returns the eigenvector of mode i labelled by X symbol.
+func (m Modes) Mode(i int) map[state.Symbol]complex128 {
+	v := make(map[state.Symbol]complex128, len(m.X))
+	for k, sym := range m.X {
+		v[sym] = m.Eigenvectors.At(k, i)
+	}
+	return v
+}
+
+// EigenModes evaluates the jacobian of sim's Diffs at s and returns it's eigen
+// decomposition. The jacobian is analytic if set with SetJacobian.
+func EigenModes(sim *Simulation, s state.State) Modes {
+	n := s.Len()
+	jac := mat.NewDense(n, n, nil)
+	sim.jacobianOf(jac, sim.diffsOf(s), s)
+	var eig mat.Eigen
+	if ok := eig.Factorize(jac, mat.EigenRight); !ok {
+		throwf("EigenModes: eigen decomposition failed at %v=%g", sim.Domain, s.Time())
+	}
+	values := eig.Values(nil)
+	var vectors mat.CDense
+	eig.VectorsTo(&vectors)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return real(values[order[i]]) > real(values[order[j]]) })
+	m := Modes{
+		State:        s,
+		Eigenvalues:  make([]complex128, n),
+		Eigenvectors: mat.NewCDense(n, n, nil),
+		X:            s.XSymbols(),
+		Damping:      make([]float64, n),
+		Frequency:    make([]float64, n),
+	}
+	for i, k := range order {
+		lambda := values[k]
+		m.Eigenvalues[i] = lambda
+		m.Frequency[i] = cmplx.Abs(lambda)
+		if m.Frequency[i] > 0 {
+			m.Damping[i] = -real(lambda) / m.Frequency[i]
+		}
+		for r := 0; r < n; r++ {
+			m.Eigenvectors.Set(r, i, vectors.At(r, k))
+		}
+	}
+	return m
+}
+
+// TrackModes returns the EigenModes at every result state of sim,
+// which must have been run beforehand.
+func TrackModes(sim *Simulation) []Modes {
+	var track []Modes
+	sim.ForEachState(func(i int, s state.State) {
+		track = append(track, EigenModes(sim, s))
+	})
+	return track
+}
+
+// FirstUnstable returns the index of the first Modes of track with an eigenvalue
+// of real part greater than tol, which should be a small positive number to ignore
+// numerical noise. Returns -1 if the whole track is stable.
+func FirstUnstable(track []Modes, tol float64) int {
+	for i, m := range track {
+		if m.MaxReal() > math.Abs(tol) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,60 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Damped oscillator x'' + 2ζωx' + ω²x = 0 has eigenvalues
+//  -ζω ± iω*sqrt(1-ζ²)
+func TestEigenModes(t *testing.T) {
+	const zeta, omega = 0.2, 3.
+	sim := New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return s.X("v") },
+		"v": func(s state.State) float64 { return -omega*omega*s.X("x") - 2*zeta*omega*s.X("v") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 1, "v": 0})
+	m := EigenModes(sim, sim.State)
+	if !m.Stable() || len(m.Eigenvalues) != 2 {
+		t.Fatalf("expected two stable modes, got %v", m.Eigenvalues)
+	}
+	for i, lambda := range m.Eigenvalues {
+		if math.Abs(real(lambda)+zeta*omega) > 1e-6 || math.Abs(math.Abs(imag(lambda))-omega*math.Sqrt(1-zeta*zeta)) > 1e-6 {
+			t.Errorf("unexpected eigenvalue %v", lambda)
+		}
+		if math.Abs(m.Damping[i]-zeta) > 1e-6 || math.Abs(m.Frequency[i]-omega) > 1e-6 {
+			t.Errorf("expected damping %g and frequency %g, got %g, %g", zeta, omega, m.Damping[i], m.Frequency[i])
+		}
+		// x' = v so mode satisfies λ*x = v
+		mode := m.Mode(i)
+		if d := lambda*mode["x"] - mode["v"]; math.Hypot(real(d), imag(d)) > 1e-6 {
+			t.Errorf("eigenvector %v does not correspond to eigenvalue %v", mode, lambda)
+		}
+	}
+}
+
+// Oscillator whose damping 1-t becomes negative after t=1.
+func TestTrackModes(t *testing.T) {
+	sim := New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return s.X("v") },
+		"v": func(s state.State) float64 { return -s.X("x") - (1-s.Time())*s.X("v") },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 1, "v": 0})
+	sim.SetTimespan(0, 2, 20)
+	sim.Begin()
+	track := TrackModes(sim)
+	if len(track) != 21 {
+		t.Fatalf("expected modes at 21 states, got %d", len(track))
+	}
+	i := FirstUnstable(track, 1e-6)
+	if i < 0 || math.Abs(track[i].State.Time()-1.1) > 1e-9 {
+		t.Errorf("expected loss of stability at t=1.1, got index %d", i)
+	}
+	if !track[0].Stable() || math.Abs(track[0].MaxReal()+0.5) > 1e-6 {
+		t.Errorf("expected stable initial modes with real part -0.5, got %v", track[0].Eigenvalues)
+	}
+}
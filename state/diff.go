@@ -31,3 +31,17 @@ func Jacobian(dst *mat.Dense, d Diffs, s State, settings *fd.JacobianSettings) *
 	fd.Jacobian(dst, f, s.x, settings)
 	return dst
 }
+
+// InputJacobian approximates jacobian matrix of Diffs system with respect to the U vector.
+// dst must be of size len(d)×len(U).
+func InputJacobian(dst *mat.Dense, d Diffs, s State, settings *fd.JacobianSettings) *mat.Dense {
+	f := func(y, u []float64) {
+		su := s.Clone()
+		copy(su.u, u)
+		for i := 0; i < len(d); i++ {
+			y[i] = d[i](su)
+		}
+	}
+	fd.Jacobian(dst, f, s.u, settings)
+	return dst
+}
@@ -12,19 +12,25 @@ type Symbol string
 // State describes a discrete simulation configuration.
 //
 // Contains X and U vectors for a step instance (i.e. point in time)
-// Can access step variable with Time() method.
+// and the P vector of model parameters, which are constant
+// unless changed by an event. Can access step variable with Time() method.
+// Assigning a State shares it's storage, use Clone for an independent copy.
 type State struct {
 	varmap     map[Symbol]int
 	x          []float64
 	inputmap   map[Symbol]int
 	u          []float64
+	parammap   map[Symbol]int
+	p          []float64
 	time       float64
 	transposed bool
+	// shared flags symbol maps shared with clones, which are copied before writing
+	shared *sharing
 }
 
 // New creates empty state
 func New() State {
-	s := State{varmap: make(map[Symbol]int), inputmap: make(map[Symbol]int)}
+	s := State{varmap: make(map[Symbol]int), inputmap: make(map[Symbol]int), parammap: make(map[Symbol]int), shared: new(sharing)}
 	// s.x, s.u = make([]float64, 0), make([]float64, 0)
 	return s
 }
@@ -61,6 +67,17 @@ func (s State) U(sym Symbol) float64 {
 	return s.u[idx]
 }
 
+// P get a State parameter.
+//
+// If state parameter does not exist then P panics
+func (s State) P(sym Symbol) float64 {
+	idx, ok := s.parammap[sym]
+	if !ok {
+		throwf("%v Symbol does not exist in State parameters", sym)
+	}
+	return s.p[idx]
+}
+
 // Vector implementation
 
 // Len returns amount of X variables in state
@@ -114,26 +131,52 @@ func (s *State) USet(sym Symbol, val float64) {
 	s.UEqual(sym, val)
 }
 
+// PEqual Set a State parameter (P) Symbol to a value.
+//
+// If Symbol does not exist then it is created
+func (s *State) PEqual(sym Symbol, val float64) {
+	s.pCreateIfNotExist(sym)
+	s.p[s.parammap[sym]] = val
+}
+
+// PSet sets an existing State parameter to a value.
+//
+// If Symbol does not exist then PSet panics
+func (s *State) PSet(sym Symbol, val float64) {
+	if _, ok := s.parammap[sym]; !ok {
+		throwf("%v Symbol does not exist in State parameters", sym)
+	}
+	s.PEqual(sym, val)
+}
+
 // Clone creates a duplicate of a State.
 func (s State) Clone() State {
+	s.share()
 	return State{
 		varmap:   s.varmap,
 		x:        s.XVector(),
 		inputmap: s.inputmap,
 		u:        s.UVector(),
+		parammap: s.parammap,
+		p:        s.PVector(),
 		time:     s.time,
+		shared:   s.shared,
 	}
 }
 
 // CloneBlank creates a duplicate of state at time `t`
 // with all X vector set to zero value
 func (s State) CloneBlank(t float64) State {
+	s.share()
 	return State{
 		varmap:   s.varmap,
 		x:        make([]float64, len(s.x)),
 		inputmap: s.inputmap,
 		u:        s.UVector(),
+		parammap: s.parammap,
+		p:        s.PVector(),
 		time:     t,
+		shared:   s.shared,
 	}
 }
 
@@ -157,6 +200,16 @@ func (s State) UVector() []float64 {
 	return cp
 }
 
+// PVector returns copy of state P vector
+func (s State) PVector() []float64 {
+	if len(s.p) == 0 {
+		return make([]float64, 0)
+	}
+	cp := make([]float64, len(s.p))
+	copy(cp, s.p)
+	return cp
+}
+
 // XSymbols returns ordered state Symbol slice
 func (s State) XSymbols() []Symbol {
 	syms := make([]Symbol, len(s.varmap))
@@ -175,6 +228,15 @@ func (s State) USymbols() []Symbol {
 	return syms
 }
 
+// PSymbols returns ordered parameter Symbol slice
+func (s State) PSymbols() []Symbol {
+	syms := make([]Symbol, len(s.parammap))
+	for sym, idx := range s.parammap {
+		syms[idx] = sym
+	}
+	return syms
+}
+
 // ConsistencyU can be used to determine if Symbols are present in U
 // and if a symbol is missing.
 //
@@ -212,6 +274,24 @@ func (s State) ConsistencyX(question []Symbol) []float64 {
 	return result
 }
 
+// ConsistencyP can be used to determine if Symbols are present in P
+// and if a symbol is missing.
+//
+// It takes a vector of Symbols and returns a vector
+// of zero floats
+//
+// If a symbol is not present in P
+// then an IEEE 754 “not-a-number” value will correspond to it.
+func (s State) ConsistencyP(question []Symbol) []float64 {
+	result := make([]float64, len(question))
+	for i, sym := range question {
+		if !s.has("P", sym) {
+			result[i] = math.NaN()
+		}
+	}
+	return result
+}
+
 // SetAllX replace all ordered X values with new ones
 func (s *State) SetAllX(new []float64) {
 	if len(s.varmap) != len(new) {
@@ -1,9 +1,53 @@
 package state
 
-import "fmt"
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Symbol maps are shared between clones so they are copied before a
+// Symbol is added (copy on write). Maps not shared are written to in place.
+
+// sharing flags which symbol maps of a State are shared with clones. Clones
+// point to the same flags so those set by Clone are seen by the original.
+// Flags are accessed atomically since states may be cloned concurrently.
+type sharing = uint32
+
+const (
+	sharedX sharing = 1 << iota
+	sharedU
+	sharedP
+	sharedAll = sharedX | sharedU | sharedP
+)
+
+// share marks all of s's symbol maps as shared.
+func (s State) share() {
+	if s.shared != nil && atomic.LoadUint32(s.shared) != sharedAll {
+		atomic.StoreUint32(s.shared, sharedAll)
+	}
+}
+
+// mustCopy reports whether the map flagged by flag must be copied before writing.
+// If so the flags of s are replaced by it's own with flag cleared.
+func (s *State) mustCopy(flag sharing) bool {
+	sh := sharedAll
+	if s.shared != nil {
+		sh = atomic.LoadUint32(s.shared)
+	}
+	if sh&flag == 0 {
+		return false
+	}
+	own := sh &^ flag
+	s.shared = &own
+	return true
+}
 
 func (s *State) xCreateIfNotExist(sym Symbol) {
 	if _, ok := s.varmap[sym]; !ok {
+		if s.mustCopy(sharedX) {
+			s.varmap = copySymbolMap(s.varmap, 1)
+			s.x = s.x[:len(s.x):len(s.x)] // do not append to a clone's storage
+		}
 		s.x = append(s.x, 0)
 		s.varmap[sym] = len(s.x) - 1
 	}
@@ -14,11 +58,34 @@ func (s *State) uCreateIfNotExist(sym Symbol) {
 		s.u = make([]float64, 0, 1)
 	}
 	if _, ok := s.inputmap[sym]; !ok {
+		if s.mustCopy(sharedU) {
+			s.inputmap = copySymbolMap(s.inputmap, 1)
+			s.u = s.u[:len(s.u):len(s.u)] // do not append to a clone's storage
+		}
 		s.u = append(s.u, 0)
 		s.inputmap[sym] = len(s.u) - 1
 	}
 }
 
+func (s *State) pCreateIfNotExist(sym Symbol) {
+	if _, ok := s.parammap[sym]; !ok {
+		if s.mustCopy(sharedP) {
+			s.parammap = copySymbolMap(s.parammap, 1)
+			s.p = s.p[:len(s.p):len(s.p)] // do not append to a clone's storage
+		}
+		s.p = append(s.p, 0)
+		s.parammap[sym] = len(s.p) - 1
+	}
+}
+
+func copySymbolMap(m map[Symbol]int, extra int) map[Symbol]int {
+	cp := make(map[Symbol]int, len(m)+extra)
+	for sym, idx := range m {
+		cp[sym] = idx
+	}
+	return cp
+}
+
 func throwf(s string, i ...interface{}) {
 	panic(fmt.Sprintf(s, i...))
 }
@@ -35,6 +102,9 @@ func (s *State) has(v string, sym Symbol) bool {
 			return false
 		}
 		return true
+	case "P":
+		_, ok := s.parammap[sym]
+		return ok
 	}
 	return false
 }
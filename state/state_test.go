@@ -129,6 +129,78 @@ func TestStateCreation(t *testing.T) {
 	}
 }
 
+// Adding symbols to a clone must not modify the original state.
+func TestCloneAddSymbol(t *testing.T) {
+	s := New()
+	s.XEqual("x", 1)
+	s.UEqual("u", 2)
+	c := s.Clone()
+	c.XEqual("y", 3)
+	c.UEqual("v", 4)
+	if s.Len() != 1 || len(s.XSymbols()) != 1 || len(s.USymbols()) != 1 {
+		t.Errorf("original state modified by clone: X %v, U %v", s.XSymbols(), s.USymbols())
+	}
+	if c.X("x") != 1 || c.X("y") != 3 || c.U("u") != 2 || c.U("v") != 4 {
+		t.Errorf("unexpected clone values: %v, %v", c.XVector(), c.UVector())
+	}
+	s.XEqual("z", 5)
+	s.PEqual("k", 6)
+	if len(c.XSymbols()) != 2 || len(c.PSymbols()) != 0 {
+		t.Errorf("clone modified by original: X %v, P %v", c.XSymbols(), c.PSymbols())
+	}
+	if s.X("z") != 5 || s.P("k") != 6 || len(s.XSymbols()) != 2 {
+		t.Errorf("unexpected original values: %v, %v", s.XVector(), s.PVector())
+	}
+}
+
+// Symbol maps not shared with clones are written in place.
+func TestAddSymbolInPlace(t *testing.T) {
+	s := New()
+	s.XEqual("x", 1)
+	m := s.varmap
+	s.XEqual("y", 2)
+	s.XEqual("z", 3)
+	if len(m) != 3 {
+		t.Errorf("expected symbol map written in place, got %v", m)
+	}
+	c := s.Clone()
+	s.XEqual("w", 4)
+	if len(m) != 3 || len(c.varmap) != 3 {
+		t.Error("symbol map shared with clone written to")
+	}
+	m = s.varmap
+	s.XEqual("v", 5)
+	if len(m) != 5 {
+		t.Errorf("expected copied symbol map written in place, got %v", m)
+	}
+}
+
+func TestParams(t *testing.T) {
+	s := New()
+	s.XEqual("x", 1)
+	s.PEqual("k", 2)
+	s.PEqual("c", 3)
+	assertVectorEqual(t, []float64{2, 3}, s.PVector())
+	if syms := s.PSymbols(); syms[0] != "k" || syms[1] != "c" {
+		t.Errorf("unexpected parameter order %v", syms)
+	}
+	c := s.Clone()
+	c.PSet("k", 4)
+	c.PEqual("d", 5)
+	if s.P("k") != 2 || len(s.PSymbols()) != 2 {
+		t.Errorf("original state modified by clone: %v", s.PVector())
+	}
+	if b := c.CloneBlank(1); b.P("k") != 4 || b.P("d") != 5 {
+		t.Errorf("parameters not kept by CloneBlank: %v", b.PVector())
+	}
+	if math.IsNaN(s.ConsistencyP([]Symbol{"k"})[0]) || !math.IsNaN(s.ConsistencyP([]Symbol{"x"})[0]) {
+		t.Error("bad parameter consistency")
+	}
+	if recoverFromSymbol(s.P, "x") == nil {
+		t.Error("looking for non existent parameter should panic")
+	}
+}
+
 func assertVectorEqual(t *testing.T, want, got []float64) {
 	if len(want) != len(got) {
 		t.Errorf("length of vectors not equal! want:%g, got:%g", want, got)
@@ -240,6 +312,25 @@ func randomState(syms ...Symbol) State {
 	return NewFromXMap(m)
 }
 
+func TestInputJacobian(t *testing.T) {
+	s := New()
+	s.XEqual("x", 2)
+	s.UEqual("u", 3)
+	s.UEqual("v", 5)
+	d := Diffs{
+		func(s State) float64 { return s.X("x") * s.U("u") },
+		func(s State) float64 { return s.U("u") * s.U("v") },
+	}
+	B := InputJacobian(mat.NewDense(2, 2, nil), d, s, nil)
+	want := mat.NewDense(2, 2, []float64{2, 0, 5, 3})
+	if !mat.EqualApprox(B, want, 1e-6) {
+		t.Errorf("unexpected input jacobian:\n%v", mat.Formatted(B))
+	}
+	if s.U("u") != 3 || s.U("v") != 5 {
+		t.Error("input jacobian modified state")
+	}
+}
+
 func TestArithmetic(t *testing.T) {
 	var testsS2 = []struct {
 		gonumF func(x, y []float64)
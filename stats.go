@@ -0,0 +1,81 @@
+package godesim
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Stats contains solver statistics of a simulation run.
+type Stats struct {
+	// Accepted is the amount of steps which make up the simulation results.
+	Accepted int
+	// Rejected is the amount of steps rejected and retried with a smaller step length.
+	Rejected int
+	// MinStep, MaxStep and MeanStep are the minimum, maximum and
+	// mean length of accepted steps.
+	MinStep, MaxStep, MeanStep float64
+	// DiffEvaluations is the amount of calls to individual Diff functions.
+	// A full evaluation of the system counts as many calls as there are X symbols.
+	DiffEvaluations int
+	// JacobianEvaluations is the amount of jacobians computed by implicit solvers,
+	// either analytic or approximated by finite differences.
+	JacobianEvaluations int
+	// LinearSolves is the amount of linear systems solved by implicit solvers.
+	LinearSolves int
+	// NewtonIterations is the amount of Newton-Raphson iterations, including
+	// those of failed steps.
+	NewtonIterations int
+	// NewtonFailures is the amount of Newton-Raphson steps which did not converge
+	// to Config.Algorithm.Newton.Tolerance within Config.Algorithm.IterationMax iterations.
+	NewtonFailures int
+	// NewtonDivergences is the amount of Newton-Raphson steps which
+	// yielded NaN or Inf values.
+	NewtonDivergences int
+	// Time is the wall time spent in each phase of the run. Jacobian
+	// and LinearSolve times are part of Solver time.
+	Time struct {
+		Total, Solver, Jacobian, LinearSolve, Events, Logging time.Duration
+	}
+}
+
+// Stats returns solver statistics of the last simulation run.
+func (sim *Simulation) Stats() Stats {
+	return sim.stats
+}
+
+// String returns a human readable report of statistics
+func (st Stats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "steps:       %d accepted, %d rejected\n", st.Accepted, st.Rejected)
+	fmt.Fprintf(&b, "step length: min %g, max %g, mean %g\n", st.MinStep, st.MaxStep, st.MeanStep)
+	fmt.Fprintf(&b, "evaluations: %d diffs, %d jacobians, %d linear solves\n", st.DiffEvaluations, st.JacobianEvaluations, st.LinearSolves)
+	fmt.Fprintf(&b, "newton:      %d iterations, %d failures, %d divergences\n", st.NewtonIterations, st.NewtonFailures, st.NewtonDivergences)
+	fmt.Fprintf(&b, "wall time:   %v total, %v solver (%v jacobian, %v linear solve), %v events, %v logging\n",
+		st.Time.Total, st.Time.Solver, st.Time.Jacobian, st.Time.LinearSolve, st.Time.Events, st.Time.Logging)
+	return b.String()
+}
+
+// addSteps records accepted steps between consecutive states.
+func (st *Stats) addSteps(states []state.State) {
+	for i := 1; i < len(states); i++ {
+		h := math.Abs(states[i].Time() - states[i-1].Time())
+		if st.Accepted == 0 || h < st.MinStep {
+			st.MinStep = h
+		}
+		st.MaxStep = math.Max(st.MaxStep, h)
+		st.MeanStep += (h - st.MeanStep) / float64(st.Accepted+1)
+		st.Accepted++
+	}
+}
+
+// countedDiff wraps f so that it's evaluations are counted in simulation Stats.
+func (sim *Simulation) countedDiff(f state.Diff) state.Diff {
+	return func(s state.State) float64 {
+		sim.stats.DiffEvaluations++
+		return f(s)
+	}
+}
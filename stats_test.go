@@ -0,0 +1,42 @@
+package godesim
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	sim := newWorkingSim()
+	sim.Algorithm.Steps = 3
+	sim.Begin()
+	st := sim.Stats()
+	const steps = 10 * 3
+	if st.Accepted != steps || st.Rejected != 0 {
+		t.Errorf("expected %d accepted and 0 rejected steps, got %d and %d", steps, st.Accepted, st.Rejected)
+	}
+	if st.DiffEvaluations != 4*steps {
+		t.Errorf("expected %d diff evaluations for RK4, got %d", 4*steps, st.DiffEvaluations)
+	}
+	h := 1. / steps
+	for _, got := range []float64{st.MinStep, st.MaxStep, st.MeanStep} {
+		if math.Abs(got-h) > 1e-12 {
+			t.Errorf("expected step length %g, got %g", h, got)
+		}
+	}
+	if st.Time.Total < st.Time.Solver {
+		t.Errorf("total time %v less than solver time %v", st.Time.Total, st.Time.Solver)
+	}
+	if !strings.Contains(st.String(), "30 accepted") {
+		t.Errorf("unexpected report:\n%s", st)
+	}
+
+	sim = newWorkingSim()
+	sim.Solver = NewtonRaphsonSolver
+	sim.Begin()
+	st = sim.Stats()
+	if st.NewtonIterations == 0 || st.LinearSolves != st.NewtonIterations || st.JacobianEvaluations != st.NewtonIterations {
+		t.Errorf("newton: expected as many linear solves and jacobians as iterations, got %d, %d and %d",
+			st.LinearSolves, st.JacobianEvaluations, st.NewtonIterations)
+	}
+}
@@ -0,0 +1,187 @@
+package godesim
+
+import (
+	"math"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+)
+
+// SteadyState is the result of FindSteadyState.
+type SteadyState struct {
+	// State is the steady state, or the last iterate if not Converged.
+	State state.State
+	// Residual is the largest absolute value of Diffs at State.
+	Residual   float64
+	Iterations int
+	Converged  bool
+	// PseudoTransient is set if Newton iterations failed and
+	// pseudo-transient continuation was used.
+	PseudoTransient bool
+}
+
+// FindSteadyState solves
+//  Diffs(x, u) = 0
+// for the X variables starting from the simulation's initial X values, which
+// are overridden by guess values. Inputs are evaluated at the initial state and kept
+// constant and parameters are those set with SetParamsFromMap.
+//
+// Damped Newton iterations are tried first. If these fail, pseudo-transient continuation
+// integrates the system with implicit Euler steps whose length grows as the residual
+// decreases, which finds stable steady states from poor guesses. Convergence
+// is configured in Config.Algorithm.SteadyState. The jacobian is analytic if set with SetJacobian.
+func FindSteadyState(sim *Simulation, guess map[state.Symbol]float64) SteadyState {
+	s := sim.State.Clone()
+	for sym, v := range guess {
+		s.XSet(sym, v)
+	}
+	sim.setParams(&s)
+	for sym := range sim.inputs {
+		s.UEqual(sym, 0)
+	}
+	for sym, f := range sim.inputs {
+		s.UEqual(sym, f(s))
+	}
+	if !sim.Symbols.NoOrdering {
+		s = orderedState(s)
+	}
+	ss := steadySolver{sim: sim, F: sim.diffsOf(s), n: s.Len()}
+	ss.tol, ss.maxIter = sim.steadyStateLimits()
+	ss.jac = mat.NewDense(ss.n, ss.n, nil)
+	res := ss.newton(s)
+	if !res.Converged {
+		ptc := ss.pseudoTransient(s)
+		ptc.Iterations += res.Iterations
+		if ptc.Converged || ptc.Residual < res.Residual {
+			res = ptc
+		}
+	}
+	return res
+}
+
+// Used when Config.Algorithm.SteadyState values are not set.
+const (
+	defaultSteadyStateTolerance    = 1e-10
+	defaultSteadyStateIterationMax = 50
+)
+
+// steadyStateLimits returns the steady state tolerance and maximum
+// amount of iterations, falling back to defaults if not configured.
+func (sim *Simulation) steadyStateLimits() (tol float64, iterMax int) {
+	tol, iterMax = sim.Algorithm.SteadyState.Tolerance, sim.Algorithm.SteadyState.IterationMax
+	if tol <= 0 {
+		tol = defaultSteadyStateTolerance
+	}
+	if iterMax <= 0 {
+		iterMax = defaultSteadyStateIterationMax
+	}
+	return tol, iterMax
+}
+
+// steadySolver holds the steady state problem
+type steadySolver struct {
+	sim     *Simulation
+	F       state.Diffs
+	n       int
+	tol     float64
+	maxIter int
+	jac     *mat.Dense
+}
+
+// residual returns Diffs at s as a vector and it's largest absolute value.
+func (ss *steadySolver) residual(s state.State) ([]float64, float64) {
+	f := make([]float64, ss.n)
+	for i := range ss.F {
+		f[i] = ss.F[i](s)
+	}
+	norm := floats.Norm(f, math.Inf(1))
+	if floats.HasNaN(f) {
+		norm = math.NaN()
+	}
+	return f, norm
+}
+
+func (ss *steadySolver) jacobian(s state.State) {
+	ss.sim.jacobianOf(ss.jac, ss.F, s)
+}
+
+// solve returns the solution dx of (shift*I - J)*dx = f. ok is false for singular
+// or ill conditioned systems.
+func (ss *steadySolver) solve(shift float64, f []float64) (dx []float64, ok bool) {
+	A := mat.NewDense(ss.n, ss.n, nil)
+	A.Scale(-1, ss.jac)
+	for i := 0; i < ss.n; i++ {
+		A.Set(i, i, shift+A.At(i, i))
+	}
+	return solveDense(A, f)
+}
+
+func (ss *steadySolver) result(s state.State, iterations int) SteadyState {
+	_, norm := ss.residual(s)
+	return SteadyState{State: s, Residual: norm, Iterations: iterations, Converged: norm <= ss.tol}
+}
+
+// newton runs damped Newton iterations from s. Steps are halved
+// until the residual decreases.
+func (ss *steadySolver) newton(s state.State) SteadyState {
+	x := s.XVector()
+	f, norm := ss.residual(s)
+	for k := 0; k < ss.maxIter; k++ {
+		if norm <= ss.tol {
+			return ss.result(s, k)
+		}
+		ss.jacobian(s)
+		// J*dx = -f  <=>  (0*I - J)*dx = f
+		dx, ok := ss.solve(0, f)
+		if !ok {
+			return ss.result(s, k)
+		}
+		accepted := false
+		for alpha := 1.; alpha > 1e-4; alpha /= 2 {
+			xn := floats.AddScaledTo(make([]float64, ss.n), x, alpha, dx)
+			sn := s.Clone()
+			sn.SetAllX(xn)
+			fn, nn := ss.residual(sn)
+			if nn < norm {
+				s, x, f, norm, accepted = sn, xn, fn, nn, true
+				break
+			}
+		}
+		if !accepted {
+			return ss.result(s, k+1)
+		}
+	}
+	return ss.result(s, ss.maxIter)
+}
+
+// pseudoTransient runs pseudo-transient continuation from s. Implicit Euler steps
+//  (I/τ - J)*dx = f
+// have their length τ updated with switched evolution relaxation.
+func (ss *steadySolver) pseudoTransient(s state.State) SteadyState {
+	x := s.XVector()
+	f, norm := ss.residual(s)
+	tau := 1e-2
+	k := 0
+	for ; k < 10*ss.maxIter && !(norm <= ss.tol); k++ {
+		ss.jacobian(s)
+		dx, ok := ss.solve(1/tau, f)
+		if !ok {
+			tau /= 10
+			continue
+		}
+		xn := floats.AddTo(make([]float64, ss.n), x, dx)
+		sn := s.Clone()
+		sn.SetAllX(xn)
+		fn, nn := ss.residual(sn)
+		if math.IsNaN(nn) || math.IsInf(nn, 0) {
+			tau /= 10
+			continue
+		}
+		tau = math.Min(tau*norm/nn, 1e12)
+		s, x, f, norm = sn, xn, fn, nn
+	}
+	res := ss.result(s, k)
+	res.PseudoTransient = true
+	return res
+}
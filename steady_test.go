@@ -0,0 +1,67 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+	"gonum.org/v1/gonum/mat"
+)
+
+func TestSteadyStateBrusselator(t *testing.T) {
+	const a, b = 1., 2.
+	sim := New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 {
+			x, y := s.X("x"), s.X("y")
+			return s.U("a") + x*x*y - (s.P("b")+1)*x
+		},
+		"y": func(s state.State) float64 {
+			x, y := s.X("x"), s.X("y")
+			return s.P("b")*x - x*x*y
+		},
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 0, "y": 0})
+	sim.SetInputFromMap(map[state.Symbol]state.Input{"a": func(state.State) float64 { return a }})
+	sim.SetParamsFromMap(map[state.Symbol]float64{"b": b})
+	ss := FindSteadyState(sim, map[state.Symbol]float64{"x": 1.3, "y": 1.5})
+	if !ss.Converged || ss.PseudoTransient || ss.Residual > 1e-10 {
+		t.Errorf("expected newton convergence, got %+v", ss)
+	}
+	if math.Abs(ss.State.X("x")-a) > 1e-9 || math.Abs(ss.State.X("y")-b/a) > 1e-9 {
+		t.Errorf("expected steady state (%g, %g), got (%g, %g)", a, b/a, ss.State.X("x"), ss.State.X("y"))
+	}
+	if sim.State.X("x") != 0 {
+		t.Error("simulation state modified")
+	}
+}
+
+// The jacobian of x' = x² - 1 is singular at the guess x = 0 so Newton's method
+// fails. Pseudo-transient continuation follows the dynamics to the stable steady state.
+func TestSteadyStatePseudoTransient(t *testing.T) {
+	sim := New()
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(s state.State) float64 { return s.X("x")*s.X("x") - 1 },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 0})
+	ss := FindSteadyState(sim, nil)
+	if !ss.Converged || !ss.PseudoTransient {
+		t.Errorf("expected pseudo-transient convergence, got %+v", ss)
+	}
+	if math.Abs(ss.State.X("x")+1) > 1e-9 {
+		t.Errorf("expected stable steady state x=-1, got %g", ss.State.X("x"))
+	}
+}
+
+// Nearly singular systems, whose determinant is not exactly zero, are not solved.
+func TestSolveDenseIllConditioned(t *testing.T) {
+	A := mat.NewDense(2, 2, []float64{1, 1, 1, 1 + 0x1p-52})
+	if x, ok := solveDense(A, []float64{1, 2}); ok {
+		t.Errorf("expected ill conditioned system to fail, got %v", x)
+	}
+	A = mat.NewDense(2, 2, []float64{2, 1, 1, 3})
+	x, ok := solveDense(A, []float64{3, 4})
+	if !ok || math.Abs(x[0]-1) > 1e-14 || math.Abs(x[1]-1) > 1e-14 {
+		t.Errorf("expected solution (1, 1), got %v", x)
+	}
+}
@@ -0,0 +1,325 @@
+package godesim
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Range is a closed interval of parameter values.
+type Range struct {
+	Min, Max float64
+}
+
+func (r Range) at(u float64) float64 { return r.Min + (r.Max-r.Min)*u }
+
+// GridDesign returns the points of a full factorial design with
+// n evenly spaced levels for each parameter, including range limits.
+// A single level is the midpoint of the range.
+func GridDesign(ranges map[state.Symbol]Range, n int) []map[state.Symbol]float64 {
+	if n < 1 {
+		throwf("GridDesign: levels must be at least 1. got %d", n)
+	}
+	syms := sortedRangeSymbols(ranges)
+	total := 1
+	for range syms {
+		total *= n
+	}
+	points := make([]map[state.Symbol]float64, total)
+	for i := range points {
+		points[i] = make(map[state.Symbol]float64, len(syms))
+		idx := i
+		// last symbol varies fastest
+		for j := len(syms) - 1; j >= 0; j-- {
+			u := 0.5
+			if n > 1 {
+				u = float64(idx%n) / float64(n-1)
+			}
+			points[i][syms[j]] = ranges[syms[j]].at(u)
+			idx /= n
+		}
+	}
+	return points
+}
+
+// LatinHypercubeDesign returns n points such that each parameter
+// range divided in n equal strata has exactly one point per stratum.
+func LatinHypercubeDesign(ranges map[state.Symbol]Range, n int, seed int64) []map[state.Symbol]float64 {
+	if n < 1 {
+		throwf("LatinHypercubeDesign: points must be at least 1. got %d", n)
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	points := newDesign(n, len(ranges))
+	for _, sym := range sortedRangeSymbols(ranges) {
+		perm := rnd.Perm(n)
+		for i := range points {
+			points[i][sym] = ranges[sym].at((float64(perm[i]) + rnd.Float64()) / float64(n))
+		}
+	}
+	return points
+}
+
+// SobolDesign returns the first n points of the Sobol low discrepancy sequence,
+// starting at the lower limit of ranges. Up to 16 parameters are supported.
+// Balance properties hold for n a power of two.
+func SobolDesign(ranges map[state.Symbol]Range, n int) []map[state.Symbol]float64 {
+	if n < 1 {
+		throwf("SobolDesign: points must be at least 1. got %d", n)
+	}
+	syms := sortedRangeSymbols(ranges)
+	seq := newSobol(len(syms))
+	points := newDesign(n, len(syms))
+	for i := range points {
+		u := seq.next()
+		for j, sym := range syms {
+			points[i][sym] = ranges[sym].at(u[j])
+		}
+	}
+	return points
+}
+
+func newDesign(n, dims int) []map[state.Symbol]float64 {
+	points := make([]map[state.Symbol]float64, n)
+	for i := range points {
+		points[i] = make(map[state.Symbol]float64, dims)
+	}
+	return points
+}
+
+// sobolDirections contains the degree s, coefficients a and initial direction numbers m
+// of dimensions 2 to 16 from S. Joe and F. Y. Kuo, new-joe-kuo-6.21201.
+var sobolDirections = []struct {
+	s, a int
+	m    []uint32
+}{
+	{1, 0, []uint32{1}},
+	{2, 1, []uint32{1, 3}},
+	{3, 1, []uint32{1, 3, 1}},
+	{3, 2, []uint32{1, 1, 1}},
+	{4, 1, []uint32{1, 1, 3, 3}},
+	{4, 4, []uint32{1, 3, 5, 13}},
+	{5, 2, []uint32{1, 1, 5, 5, 17}},
+	{5, 4, []uint32{1, 1, 5, 5, 5}},
+	{5, 7, []uint32{1, 1, 7, 11, 19}},
+	{5, 11, []uint32{1, 1, 5, 1, 1}},
+	{5, 13, []uint32{1, 1, 1, 3, 11}},
+	{5, 14, []uint32{1, 3, 5, 5, 31}},
+	{6, 1, []uint32{1, 3, 3, 9, 7, 49}},
+	{6, 13, []uint32{1, 1, 1, 15, 21, 21}},
+	{6, 16, []uint32{1, 3, 1, 13, 27, 49}},
+}
+
+// sobol generates Sobol points in the unit hypercube using Gray code ordering.
+type sobol struct {
+	v     [][32]uint32
+	x     []uint32
+	index uint32
+}
+
+func newSobol(dims int) *sobol {
+	if dims > len(sobolDirections)+1 {
+		throwf("SobolDesign: at most %d parameters supported. got %d", len(sobolDirections)+1, dims)
+	}
+	sb := &sobol{v: make([][32]uint32, dims), x: make([]uint32, dims)}
+	for k := 0; k < 32; k++ {
+		sb.v[0][k] = 1 << (31 - k)
+	}
+	for d := 1; d < dims; d++ {
+		dir := sobolDirections[d-1]
+		v := &sb.v[d]
+		for k := 0; k < 32; k++ {
+			if k < dir.s {
+				v[k] = dir.m[k] << (31 - k)
+				continue
+			}
+			v[k] = v[k-dir.s] ^ (v[k-dir.s] >> dir.s)
+			for j := 1; j < dir.s; j++ {
+				v[k] ^= uint32((dir.a>>(dir.s-1-j))&1) * v[k-j]
+			}
+		}
+	}
+	return sb
+}
+
+// next returns the next point of the sequence. The first point is the origin.
+func (sb *sobol) next() []float64 {
+	if sb.index > 0 {
+		// position of lowest zero bit of previous index
+		c, i := 0, sb.index-1
+		for i&1 == 1 {
+			i >>= 1
+			c++
+		}
+		for d := range sb.x {
+			sb.x[d] ^= sb.v[d][c]
+		}
+	}
+	sb.index++
+	u := make([]float64, len(sb.x))
+	for d, x := range sb.x {
+		u[d] = float64(x) / (1 << 32)
+	}
+	return u
+}
+
+// Sweep runs a model for each point of a parameter design in parallel
+// and summarizes the results of each run.
+//
+// Model must not return Simulations which share mutable data such as Eventers.
+// Pointer Integrators and StepControllers are copied for each run.
+type Sweep struct {
+	// Model returns a Simulation ready to Begin for the design point parameters.
+	// Parameters set with Simulation.SetParamsFromMap are overridden by the design point.
+	Model func(params map[state.Symbol]float64) *Simulation
+	// Design contains the parameters of each run. See GridDesign,
+	// LatinHypercubeDesign and SobolDesign.
+	Design []map[state.Symbol]float64
+	// Workers is the amount of simulations run concurrently.
+	// Default is runtime.GOMAXPROCS(0).
+	Workers int
+}
+
+// SweepRow is the summary of a single Sweep run.
+type SweepRow struct {
+	Params map[state.Symbol]float64
+	// Final, Min and Max contain the final, minimum and maximum
+	// values of each X and U symbol.
+	Final, Min, Max map[state.Symbol]float64
+	// Events contains the domain values at which each event label happened.
+	Events map[string][]float64
+	// Err is the recovered panic of a failed run. nil on success.
+	Err error
+}
+
+// SweepTable contains the summaries of Sweep runs keyed by parameter values.
+type SweepTable struct {
+	// Params are the sorted parameter symbols
+	Params []state.Symbol
+	// Rows are ordered as the Sweep's Design
+	Rows []SweepRow
+}
+
+// Run runs the sweep. Panics of individual runs are recovered
+// and stored in their row.
+func (sw Sweep) Run() SweepTable {
+	if sw.Model == nil {
+		throwf("Sweep: Model not set")
+	}
+	var syms []state.Symbol
+	if len(sw.Design) > 0 {
+		for sym := range sw.Design[0] {
+			syms = append(syms, sym)
+		}
+		sort.Slice(syms, func(i, j int) bool { return syms[i] < syms[j] })
+	}
+	tbl := SweepTable{Params: syms, Rows: make([]SweepRow, len(sw.Design))}
+	parallel(len(sw.Design), sw.Workers, func(i int) {
+		tbl.Rows[i] = sw.run(i)
+	})
+	return tbl
+}
+
+func (sw Sweep) run(i int) (row SweepRow) {
+	row.Params = sw.Design[i]
+	defer func() {
+		if a := recover(); a != nil {
+			row.Err = fmt.Errorf("sweep run %d: %v", i, a)
+		}
+	}()
+	sim := sw.Model(row.Params)
+	sim.isolate()
+	sim.overrideParams(row.Params)
+	sim.Begin()
+	syms := append(sim.State.XSymbols(), sim.State.USymbols()...)
+	row.Final = make(map[state.Symbol]float64, len(syms))
+	row.Min = make(map[state.Symbol]float64, len(syms))
+	row.Max = make(map[state.Symbol]float64, len(syms))
+	for _, sym := range syms {
+		v := sim.Results(sym)
+		row.Final[sym] = v[len(v)-1]
+		row.Min[sym], row.Max[sym] = math.Inf(1), math.Inf(-1)
+		for _, f := range v {
+			row.Min[sym] = math.Min(row.Min[sym], f)
+			row.Max[sym] = math.Max(row.Max[sym], f)
+		}
+	}
+	row.Events = make(map[string][]float64)
+	for _, ev := range sim.Events() {
+		row.Events[ev.Label] = append(row.Events[ev.Label], ev.State.Time())
+	}
+	return row
+}
+
+// Find returns the row whose parameters equal params.
+func (tbl SweepTable) Find(params map[state.Symbol]float64) (SweepRow, bool) {
+	for _, row := range tbl.Rows {
+		if len(row.Params) != len(params) {
+			continue
+		}
+		match := true
+		for sym, v := range params {
+			if p, ok := row.Params[sym]; !ok || p != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			return row, true
+		}
+	}
+	return SweepRow{}, false
+}
+
+// WriteCSV writes the table with a column for each parameter followed by the
+// final, minimum and maximum values of syms and the error of failed runs.
+func (tbl SweepTable) WriteCSV(w io.Writer, syms ...state.Symbol) error {
+	cw := csv.NewWriter(w)
+	header := make([]string, 0, len(tbl.Params)+3*len(syms)+1)
+	for _, p := range tbl.Params {
+		header = append(header, string(p))
+	}
+	for _, sym := range syms {
+		header = append(header, string(sym)+"_final", string(sym)+"_min", string(sym)+"_max")
+	}
+	if err := cw.Write(append(header, "error")); err != nil {
+		return err
+	}
+	format := func(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+	for _, row := range tbl.Rows {
+		record := make([]string, 0, len(header))
+		for _, p := range tbl.Params {
+			record = append(record, format(row.Params[p]))
+		}
+		for _, sym := range syms {
+			if row.Err != nil {
+				record = append(record, "", "", "")
+				continue
+			}
+			record = append(record, format(row.Final[sym]), format(row.Min[sym]), format(row.Max[sym]))
+		}
+		errMsg := ""
+		if row.Err != nil {
+			errMsg = row.Err.Error()
+		}
+		if err := cw.Write(append(record, errMsg)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func sortedRangeSymbols(m map[state.Symbol]Range) []state.Symbol {
+	syms := make([]state.Symbol, 0, len(m))
+	for sym := range m {
+		syms = append(syms, sym)
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i] < syms[j] })
+	return syms
+}
@@ -0,0 +1,155 @@
+package godesim
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/soypat/godesim/state"
+)
+
+func TestGridDesign(t *testing.T) {
+	points := GridDesign(map[state.Symbol]Range{"a": {0, 1}, "b": {10, 20}}, 3)
+	if len(points) != 9 {
+		t.Fatalf("expected 9 points, got %d", len(points))
+	}
+	if points[0]["a"] != 0 || points[0]["b"] != 10 || points[1]["b"] != 15 || points[8]["a"] != 1 || points[8]["b"] != 20 {
+		t.Errorf("unexpected grid points %v", points)
+	}
+}
+
+// Latin hypercube and Sobol designs have one point per stratum of each parameter.
+func TestDesignStrata(t *testing.T) {
+	const n = 32
+	ranges := map[state.Symbol]Range{}
+	for _, sym := range []state.Symbol{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		ranges[sym] = Range{-1, 1}
+	}
+	for name, points := range map[string][]map[state.Symbol]float64{
+		"lhs":   LatinHypercubeDesign(ranges, n, 1),
+		"sobol": SobolDesign(ranges, n),
+	} {
+		for sym := range ranges {
+			count := make([]int, n)
+			for _, p := range points {
+				count[int((p[sym]+1)/2*n)]++
+			}
+			for i, c := range count {
+				if c != 1 {
+					t.Errorf("%s: parameter %s has %d points in stratum %d", name, sym, c, i)
+				}
+			}
+		}
+	}
+	// Sobol points are also stratified in 2D elementary intervals of area 1/n
+	points := SobolDesign(map[state.Symbol]Range{"a": {0, 1}, "b": {0, 1}}, n)
+	for bits := 0; bits <= 5; bits++ {
+		na, nb := 1<<bits, n>>bits
+		count := make(map[[2]int]int)
+		for _, p := range points {
+			count[[2]int{int(p["a"] * float64(na)), int(p["b"] * float64(nb))}]++
+		}
+		if len(count) != n {
+			t.Errorf("sobol: %d of %d elementary intervals %dx%d have points", len(count), n, na, nb)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	sw := Sweep{
+		Model: func(p map[state.Symbol]float64) *Simulation {
+			if p["k"] < 0 {
+				panic("negative rate")
+			}
+			sim := New()
+			sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+				"x": func(s state.State) float64 { return -p["k"] * s.X("x") },
+			})
+			sim.SetX0FromMap(map[state.Symbol]float64{"x": p["x0"]})
+			sim.Algorithm.Steps = 10
+			sim.SetTimespan(0, 1, 10)
+			sim.AddEventHandlers(TypicalEventer{label: "half", action: func(s state.State) func(*Simulation) error {
+				if s.X("x") < p["x0"]/2 {
+					return EndSimulation
+				}
+				return nil
+			}})
+			return sim
+		},
+		Design:  GridDesign(map[state.Symbol]Range{"k": {-1, 2}, "x0": {1, 2}}, 4),
+		Workers: 3,
+	}
+	tbl := sw.Run()
+	if len(tbl.Rows) != 16 || len(tbl.Params) != 2 {
+		t.Fatalf("expected 16 rows of 2 parameters, got %d of %d", len(tbl.Rows), len(tbl.Params))
+	}
+	for _, row := range tbl.Rows {
+		k, x0 := row.Params["k"], row.Params["x0"]
+		if (row.Err != nil) != (k < 0) {
+			t.Errorf("k=%g: unexpected error %v", k, row.Err)
+			continue
+		}
+		if row.Err != nil {
+			continue
+		}
+		halves := row.Events["half"]
+		if k > math.Ln2 && len(halves) != 1 {
+			t.Errorf("k=%g: expected one half life event, got %v", k, halves)
+		}
+		if len(halves) == 1 {
+			if want := math.Ln2 / k; halves[0] < want || halves[0] > want+0.1+1e-9 {
+				t.Errorf("k=%g: half life event at %g, want in [%g, %g]", k, halves[0], want, want+0.1)
+			}
+			continue
+		}
+		if want := x0 * math.Exp(-k); math.Abs(row.Final["x"]-want) > 1e-6 {
+			t.Errorf("k=%g, x0=%g: final x %g, want %g", k, x0, row.Final["x"], want)
+		}
+		if row.Max["x"] != x0 || row.Min["x"] != row.Final["x"] {
+			t.Errorf("k=%g: unexpected extrema %g, %g", k, row.Min["x"], row.Max["x"])
+		}
+	}
+	row, ok := tbl.Find(map[state.Symbol]float64{"k": 0, "x0": 1})
+	if !ok || row.Final["x"] != 1 {
+		t.Errorf("Find: got %v, %t", row, ok)
+	}
+	var buf bytes.Buffer
+	if err := tbl.WriteCSV(&buf, "x"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 17 || lines[0] != "k,x0,x_final,x_min,x_max,error" {
+		t.Errorf("unexpected csv:\n%s", buf.String())
+	}
+}
+
+// Runs of Models sharing a stateful Integrator and StepController
+// must not modify them.
+func TestSweepIsolation(t *testing.T) {
+	integrator, controller := &DormandPrince{}, &PIDController{}
+	tbl := Sweep{
+		Model: func(p map[state.Symbol]float64) *Simulation {
+			sim := New()
+			sim.Integrator, sim.StepController = integrator, controller
+			sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+				"x": func(s state.State) float64 { return -p["k"] * s.X("x") },
+			})
+			sim.SetX0FromMap(map[state.Symbol]float64{"x": 1})
+			sim.Algorithm.Error.AbsTol = 1e-6
+			sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-4, 0.1
+			sim.SetTimespan(0, 1, 10)
+			return sim
+		},
+		Design:  GridDesign(map[state.Symbol]Range{"k": {1, 2}}, 8),
+		Workers: 4,
+	}.Run()
+	if integrator.StepLength() != 0 || controller.errs != [2]float64{} {
+		t.Errorf("shared integrator or step controller modified by sweep runs")
+	}
+	for _, row := range tbl.Rows {
+		if want := math.Exp(-row.Params["k"]); row.Err != nil || math.Abs(row.Final["x"]-want) > 1e-5 {
+			t.Errorf("k=%g: final x %g, want %g. error: %v", row.Params["k"], row.Final["x"], want, row.Err)
+		}
+	}
+}
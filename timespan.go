@@ -1,12 +1,21 @@
 package godesim
 
-// Timespan represents an iterable vector of evenly spaced time points.
-// Does not store state information on steps done.
+import (
+	"math"
+	"sort"
+)
+
+// Timespan represents an iterable vector of time points, evenly
+// spaced unless set with SetTimespanLog or SetTimespanPoints.
+// Does not store state information on steps done. End may be
+// less than start, in which case the domain is integrated backward.
 type Timespan struct {
 	start      float64
 	end        float64
 	steps      int
 	stepLength float64
+	// points of non-uniform timespans, start and end included. nil if evenly spaced.
+	points []float64
 }
 
 // Len how many iterations expected for RK4
@@ -14,12 +23,14 @@ func (ts Timespan) Len() int {
 	return ts.steps
 }
 
-// Dt Obtains the step length of simulation
+// Dt Obtains the step length of simulation. Negative
+// for backward timespans. For non-uniform timespans this is
+// the mean step length, see Simulation.Dt.
 func (ts Timespan) Dt() float64 {
 	return ts.stepLength
 }
 
-// End returns greater limit of Timespan
+// End returns the limit of Timespan the simulation ends at
 func (ts Timespan) End() float64 {
 	return ts.end
 }
@@ -27,7 +38,8 @@ func (ts Timespan) End() float64 {
 // SetTimespan Set time domain (step domain) for simulation.
 // Step size is given by:
 //   dt = (End - Start) / float64(Steps)
-// since Steps is the amount of points to "solve".
+// since Steps is the amount of points to "solve". End may be less
+// than Start to integrate backward from a terminal condition.
 func (ts *Timespan) SetTimespan(Start, End float64, Steps int) {
 	(*ts) = newTimespan(Start, End, Steps)
 }
@@ -43,12 +55,69 @@ const (
 	dlamchP = dlamchB * dlamchE
 )
 
+// SetTimespanLog sets a time domain of Steps intervals whose points are
+// logarithmically spaced between Start and End, which must be non-zero and of
+// the same sign. Useful to resolve fast initial transients:
+//  sim.SetTimespanLog(1e-6, 1e3, 90) // 10 points per decade
+// To start at zero use SetTimespanPoints.
+func (ts *Timespan) SetTimespanLog(Start, End float64, Steps int) {
+	if Start*End <= 0 {
+		throwf("Timespan: logarithmic Start and End must be non-zero and of same sign. got %v, %v", Start, End)
+	}
+	if Steps < 1 {
+		throwf("Timespan: Steps must be greater or equal to 1. got %v", Steps)
+	}
+	points := make([]float64, Steps+1)
+	ratio := math.Log(End / Start)
+	for i := range points {
+		points[i] = Start * math.Exp(ratio*float64(i)/float64(Steps))
+	}
+	points[0], points[Steps] = Start, End
+	ts.SetTimespanPoints(points)
+}
+
+// SetTimespanPoints sets a time domain from explicit points at which results are
+// stored. Points must be strictly increasing or strictly decreasing and
+// contain at least two values. The first point is the start of the simulation.
+func (ts *Timespan) SetTimespanPoints(points []float64) {
+	if len(points) < 2 {
+		throwf("Timespan: at least two points required. got %d", len(points))
+	}
+	start, end := points[0], points[len(points)-1]
+	for i := 1; i < len(points); i++ {
+		if (points[i]-points[i-1])*(end-start) <= 0 {
+			throwf("Timespan: points must be strictly monotonic. got %v after %v", points[i], points[i-1])
+		}
+	}
+	(*ts) = newTimespan(start, end, len(points)-1)
+	ts.points = append([]float64{}, points...)
+}
+
+// dtAt returns the length of the interval starting at domain value t.
+// Returns 0 if t is at the end of a non-uniform timespan.
+func (ts Timespan) dtAt(t float64) float64 {
+	if ts.points == nil {
+		return ts.stepLength
+	}
+	dir := math.Copysign(1, ts.end-ts.start)
+	// first point ahead of t
+	k := sort.Search(len(ts.points), func(i int) bool { return dir*(ts.points[i]-t) > 0 })
+	// solvers may fall short of a point by rounding errors
+	if k > 0 && k < len(ts.points) && dir*(ts.points[k]-t) < 1e-9*math.Abs(ts.points[k]-ts.points[k-1]) {
+		k++
+	}
+	if k >= len(ts.points) {
+		return 0
+	}
+	return ts.points[k] - t
+}
+
 // newTimespan generates a timespan object for simulation.
 // Steps must be minimum 1.
 func newTimespan(Start, End float64, Steps int) Timespan {
 
-	if Start >= End {
-		throwf("Timespan: Start cannot be greater or equal to End. got %v >= %v", Start, End)
+	if Start == End {
+		throwf("Timespan: Start cannot be equal to End. got %v", Start)
 	}
 	if Steps < 1 {
 		throwf("Timespan: Steps must be greater or equal to 1. got %v", Steps)
@@ -56,7 +125,7 @@ func newTimespan(Start, End float64, Steps int) Timespan {
 
 	dt := (End - Start) / float64(Steps)
 
-	if dt <= 2*dlamchP {
+	if math.Abs(dt) <= 2*dlamchP {
 		warnf("warning: time step %e is smaller than eps*2", dt)
 	}
 	return Timespan{
@@ -66,3 +135,16 @@ func newTimespan(Start, End float64, Steps int) Timespan {
 		stepLength: dt,
 	}
 }
+
+// grid returns the domain values at which Timespan intervals start and end.
+func (ts Timespan) grid() []float64 {
+	if ts.points != nil {
+		return append([]float64{}, ts.points...)
+	}
+	g := make([]float64, ts.steps+1)
+	for i := range g {
+		g[i] = ts.start + float64(i)*ts.stepLength
+	}
+	g[ts.steps] = ts.end
+	return g
+}
@@ -0,0 +1,83 @@
+package godesim
+
+import (
+	"math"
+
+	"github.com/soypat/godesim/state"
+)
+
+// Tolerance is the relative and absolute error permitted on an X variable
+// by adaptive solvers. Both values are set so that a zero Rel selects absolute
+// error only. If Abs is zero minAbsTol is used. Both may not be zero.
+type Tolerance struct {
+	Rel float64 `yaml:"rel"`
+	Abs float64 `yaml:"abs"`
+}
+
+// tolerances contains relative and absolute tolerance of X variables ordered as X symbols
+type tolerances struct {
+	rel, abs []float64
+}
+
+// hasTolerance returns true if error tolerances are configured for adaptive stepping.
+func (sim *Simulation) hasTolerance() bool {
+	e := sim.Algorithm.Error
+	return e.Max > 0 || e.RelTol > 0 || e.AbsTol > 0 || len(e.Symbols) > 0
+}
+
+const (
+	// defaultAbsTol is the absolute tolerance of X variables when no
+	// tolerance nor Config.Algorithm.Error.Max is configured.
+	defaultAbsTol = 1e-6
+	// minAbsTol is the absolute tolerance of X variables when only a relative
+	// tolerance is configured so that error weights of variables at zero are not zero.
+	minAbsTol = 1e-12
+)
+
+// setTolerances generates per X variable tolerances from configuration.
+// If no relative or absolute tolerance is set Config.Algorithm.Error.Max is used
+// as absolute tolerance, or defaultAbsTol if not set either.
+// If no absolute tolerance results minAbsTol is used.
+func (sim *Simulation) setTolerances() {
+	e := sim.Algorithm.Error
+	syms := sim.State.XSymbols()
+	rel, abs := e.RelTol, e.AbsTol
+	if rel == 0 && abs == 0 {
+		abs = e.Max
+		if abs <= 0 {
+			abs = defaultAbsTol
+		}
+	}
+	if abs == 0 {
+		abs = minAbsTol
+	}
+	sim.tolerances = tolerances{rel: make([]float64, len(syms)), abs: make([]float64, len(syms))}
+	for i, sym := range syms {
+		sim.tolerances.rel[i], sim.tolerances.abs[i] = rel, abs
+		if tol, ok := e.Symbols[sym]; ok {
+			sim.tolerances.rel[i], sim.tolerances.abs[i] = tol.Rel, math.Max(tol.Abs, minAbsTol)
+		}
+	}
+	for sym, tol := range e.Symbols {
+		if math.IsNaN(sim.State.ConsistencyX([]state.Symbol{sym})[0]) {
+			throwf("config: error tolerance symbol %v not found in X symbols", sym)
+		}
+		if tol.Rel <= 0 && tol.Abs <= 0 {
+			throwf("config: error tolerance of symbol %v not set", sym)
+		}
+	}
+}
+
+// errorNorm returns the weighted root mean square norm of error estimate err
+// for a step from y0 to y1:
+//  sqrt( 1/n * sum( (err_i / (abs_i + rel_i*max(|y0_i|, |y1_i|)))^2 ) )
+// A step is within tolerance if the norm is not greater than 1.
+func (sim *Simulation) errorNorm(err, y0, y1 state.State) float64 {
+	e, x0, x1 := err.XVector(), y0.XVector(), y1.XVector()
+	sum := 0.
+	for i := range e {
+		w := sim.tolerances.abs[i] + sim.tolerances.rel[i]*math.Max(math.Abs(x0[i]), math.Abs(x1[i]))
+		sum += (e[i] / w) * (e[i] / w)
+	}
+	return math.Sqrt(sum / float64(len(e)))
+}
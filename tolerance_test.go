@@ -0,0 +1,139 @@
+package godesim
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/soypat/godesim/state"
+)
+
+func TestErrorNorm(t *testing.T) {
+	sim := newWorkingSim()
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 1, "y": 100})
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(state.State) float64 { return 1 },
+		"y": func(state.State) float64 { return 1 },
+	})
+	sim.Algorithm.Error.RelTol, sim.Algorithm.Error.AbsTol = 1e-3, 1e-6
+	sim.Algorithm.Error.Symbols = map[state.Symbol]Tolerance{"y": {Rel: 1e-3, Abs: 1}}
+	sim.verifyPreBegin()
+	y0 := sim.State.Clone()
+	y1 := sim.State.Clone()
+	y1.XSet("y", 200)
+	errEst := sim.State.CloneBlank(0)
+	errEst.XSet("x", 2e-3)
+	errEst.XSet("y", 0.6)
+	// weights: x: 1e-6 + 1e-3*1 ~ 1e-3, y: 1 + 1e-3*200 = 1.2
+	want := math.Sqrt((math.Pow(2e-3/(1e-6+1e-3), 2) + math.Pow(0.6/1.2, 2)) / 2)
+	if got := sim.errorNorm(errEst, y0, y1); math.Abs(got-want) > 1e-12 {
+		t.Errorf("error norm: got %g, want %g", got, want)
+	}
+}
+
+func TestToleranceBadSymbol(t *testing.T) {
+	sim := newWorkingSim()
+	sim.Algorithm.Error.Symbols = map[state.Symbol]Tolerance{"nonexistent": {Rel: 1}}
+	if err := recoverSimTest(sim); err == nil {
+		t.Error("expected panic for tolerance of non existent symbol")
+	}
+}
+
+// Positions and velocities of very different scales
+// integrated with a single relative tolerance.
+func TestRelativeTolerance(t *testing.T) {
+	const omega, r = 1e-5, 1e8
+	for _, solver := range []struct {
+		name string
+		f    func(*Simulation) []state.State
+	}{{"rkf45", RKF45Solver}, {"dormandPrince", DormandPrinceSolver}, {"rkf78", RKF78Solver}} {
+		sim := New()
+		sim.Solver = solver.f
+		sim.Algorithm.Error.RelTol, sim.Algorithm.Error.AbsTol = 1e-8, 1e-3
+		sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1, 1e5
+		sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+			"x":  func(s state.State) float64 { return s.X("Dx") },
+			"Dx": func(s state.State) float64 { return -omega * omega * s.X("x") },
+		})
+		sim.SetX0FromMap(map[state.Symbol]float64{"x": r, "Dx": 0})
+		sim.SetTimespan(0, 2*math.Pi/omega, 10)
+		sim.Begin()
+		time, x := sim.Results("time"), sim.Results("x")
+		for i := range x {
+			if want := r * math.Cos(omega*time[i]); math.Abs(x[i]-want) > 1e-5*r {
+				t.Errorf("%s: got x=%g, want %g", solver.name, x[i], want)
+			}
+		}
+	}
+}
+
+// Variables which stay at zero must not have zero error weight
+// when only a relative tolerance is set.
+func TestRelativeToleranceZeroVariable(t *testing.T) {
+	sim := New()
+	sim.Solver = RKF45Solver
+	sim.Algorithm.Error.RelTol = 1e-6
+	sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-6, 0.1
+	sim.SetDiffFromMap(map[state.Symbol]state.Diff{
+		"x": func(state.State) float64 { return 0 },
+	})
+	sim.SetX0FromMap(map[state.Symbol]float64{"x": 0})
+	sim.SetTimespan(0, 1, 10)
+	done := make(chan interface{})
+	go func() { done <- recoverSimTest(sim) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected simulation failure: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("simulation did not finish")
+	}
+}
+
+type nanController struct{}
+
+func (nanController) Step(h, errNorm float64, order int) (float64, bool) { return math.NaN(), true }
+func (nanController) Reset()                                             {}
+
+func TestNonFiniteStep(t *testing.T) {
+	sim := newWorkingSim()
+	sim.Solver = RKF45Solver
+	sim.Algorithm.Error.Max = 1e-6
+	sim.Algorithm.Step.Min, sim.Algorithm.Step.Max = 1e-6, 0.1
+	sim.StepController = nanController{}
+	if err := recoverSimTest(sim); err == nil {
+		t.Error("expected panic for NaN step length")
+	}
+}
+
+// Without tolerances configured the absolute tolerance does not depend on Newton defaults.
+func TestDefaultTolerance(t *testing.T) {
+	sim := newWorkingSim()
+	sim.verifyPreBegin()
+	if got := sim.tolerances.abs[0]; got != defaultAbsTol {
+		t.Errorf("expected default absolute tolerance %g, got %g", defaultAbsTol, got)
+	}
+	sim = newWorkingSim()
+	sim.Algorithm.Error.Max = 1e-3
+	sim.verifyPreBegin()
+	if got := sim.tolerances.abs[0]; got != 1e-3 {
+		t.Errorf("expected Error.Max as absolute tolerance, got %g", got)
+	}
+}
+
+// Symbol tolerances set both values so that a symbol may use absolute error only.
+func TestToleranceSymbolAbsolute(t *testing.T) {
+	sim := newWorkingSim()
+	sim.Algorithm.Error.RelTol = 1e-3
+	sim.Algorithm.Error.Symbols = map[state.Symbol]Tolerance{"x": {Abs: 1e-4}}
+	sim.verifyPreBegin()
+	if rel, abs := sim.tolerances.rel[0], sim.tolerances.abs[0]; rel != 0 || abs != 1e-4 {
+		t.Errorf("expected absolute tolerance only, got rel %g, abs %g", rel, abs)
+	}
+	sim = newWorkingSim()
+	sim.Algorithm.Error.Symbols = map[state.Symbol]Tolerance{"x": {}}
+	if err := recoverSimTest(sim); err == nil {
+		t.Error("expected panic for zero symbol tolerance")
+	}
+}